@@ -0,0 +1,148 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A Backoff decides how long to wait before retrying a request. Next is
+// called with the number of the retry, starting at 0.
+type Backoff interface {
+	Next(attempt int) time.Duration
+}
+
+// ConstantBackoff waits the same time before every retry.
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) Next(attempt int) time.Duration { return time.Duration(b) }
+
+// ExponentialBackoff doubles the wait, starting at Base, with every retry up
+// to Max, if set. With Jitter the wait is picked at random between zero and
+// that value, which spreads out retries of many clients.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter bool
+}
+
+func (b ExponentialBackoff) Next(attempt int) time.Duration {
+	d := b.Base
+	for i := 0; i < attempt && (b.Max == 0 || d < b.Max); i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter && d > 0 {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	return d
+}
+
+// WithBackoff sets the wait between retries of DNS queries, see
+// WithDNSRetries, and HTTP requests, see WithHTTPRetries. Without it retries
+// are sent right away.
+func WithBackoff(b Backoff) Option {
+	return func(c *Client) error {
+		c.backoff = b
+		return nil
+	}
+}
+
+// WithHTTPRetries makes the client retry requests that only read, like Get
+// and GetAllServices, up to n times when they fail without a response or the
+// server answers 502, 503 or 504. Mutating requests are never retried.
+func WithHTTPRetries(n int) Option {
+	return func(c *Client) error {
+		if n < 0 {
+			return ErrInvalidRetries
+		}
+		c.httpRetries = n
+		return nil
+	}
+}
+
+// wait sleeps before retry attempt, it returns early with the error of ctx
+// when ctx is done first.
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	if c.backoff == nil {
+		return ctx.Err()
+	}
+	t := time.NewTimer(c.backoff.Next(attempt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryableStatus reports whether a read answered with code is worth
+// retrying, as the server or a proxy in front of it is temporarily failing.
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// doRetry sends the read request req with send and retries it as set by
+// WithHTTPRetries.
+func (c *Client) doRetry(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, err := send(req.Clone(ctx))
+		if attempt >= c.httpRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			if !retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+		if werr := c.wait(ctx, attempt); werr != nil {
+			return nil, werr
+		}
+		atomic.AddInt64(&c.stats.retries, 1)
+	}
+}
+
+// sendReset sends req with sendOnce and, if the connection was reset or closed
+// before a response came, as happens when a server restarts, sends it once
+// more. This applies to writes too: the request may be sent twice if the
+// server went away after processing it, which for the registry's PUT, PATCH
+// and DELETE of a UUID has the same effect as sending it once.
+func (c *Client) sendReset(req *http.Request) (*http.Response, error) {
+	resp, err := c.sendOnce(req)
+	if err == nil || !isConnReset(err) || req.Context().Err() != nil {
+		return resp, err
+	}
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, err
+		}
+		body, berr := req.GetBody()
+		if berr != nil {
+			return resp, err
+		}
+		retry.Body = body
+	}
+	atomic.AddInt64(&c.stats.retries, 1)
+	return c.sendOnce(retry)
+}
+
+// isConnReset reports whether err is a reset connection, or one the server
+// closed without answering, like an idle keep-alive connection.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+	"io"
+	"net"
+	"sync"
+)
+
+// ImportOptions tune ImportContext.
+type ImportOptions struct {
+	// Concurrency is the number of requests made at a time, at least 1.
+	Concurrency int
+
+	// Resume leaves services that are already registered untouched, so an
+	// import can be run again after it was canceled or failed half-way.
+	Resume bool
+
+	// Progress, if set, is called after each service with the number of
+	// services handled so far and the total. It may be called concurrently.
+	Progress func(done, total int)
+}
+
+// Export writes all registered services to w as a JSON array, in the format
+// read back by Import. The services are streamed from StreamAllServices in
+// the order the server sends them, one at a time; if the stream fails w is
+// left with an incomplete array.
+func (c *Client) Export(w io.Writer) error {
+	return c.ExportContext(context.Background(), w)
+}
+
+// ExportContext is like Export, but the request is bound to ctx.
+func (c *Client) ExportContext(ctx context.Context, w io.Writer) error {
+	sep := "["
+	err := c.StreamAllServices(ctx, func(s *msg.Service) error {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		sep = ","
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sep == "[" {
+		_, err = io.WriteString(w, "[]\n")
+	} else {
+		_, err = io.WriteString(w, "]\n")
+	}
+	return err
+}
+
+// ExportZone writes all registered services to w as a zone file in RFC 1035
+// master file format, with the client's domain as the origin. Every service
+// gets an SRV record under its full SkyDNS name. Like the SkyDNS server does,
+// services that registered an IP address point at <uuid>.<domain>, which gets
+// an A or AAAA record, other services point at their host.
+func (c *Client) ExportZone(w io.Writer) error {
+	services, err := c.GetAllServices()
+	if err != nil {
+		return err
+	}
+	services = withoutNil(services)
+	sortServices(services)
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s\n", c.domain); err != nil {
+		return err
+	}
+	for _, s := range services {
+		for _, rr := range c.zoneRecords(s) {
+			if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// zoneRecords returns the records SkyDNS serves for s.
+func (c *Client) zoneRecords(s *msg.Service) []dns.RR {
+	srv := ServiceToSRV(c.qualify(serviceName(s)), c.domain, s)
+	ip := net.ParseIP(s.Host)
+	if ip == nil {
+		return []dns.RR{srv}
+	}
+	hdr := dns.RR_Header{Name: srv.Target, Class: dns.ClassINET, Ttl: s.TTL}
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = dns.TypeA
+		return []dns.RR{srv, &dns.A{Hdr: hdr, A: ip4}}
+	}
+	hdr.Rrtype = dns.TypeAAAA
+	return []dns.RR{srv, &dns.AAAA{Hdr: hdr, AAAA: ip}}
+}
+
+// Import reads a JSON array of services, as written by Export, from r and
+// adds each under its UUID, using up to concurrency requests at a time. It
+// returns the errors keyed by UUID; the map is empty when all services were
+// added. If r cannot be decoded nothing is added and the error is returned
+// under the empty key.
+func (c *Client) Import(r io.Reader, concurrency int) map[string]error {
+	return c.ImportContext(context.Background(), r, ImportOptions{Concurrency: concurrency})
+}
+
+// ImportContext is like Import, with the options in opts. When ctx is done
+// no more services are added, the ones not attempted are reported with the
+// error of ctx.
+func (c *Client) ImportContext(ctx context.Context, r io.Reader, opts ImportOptions) map[string]error {
+	errs := make(map[string]error)
+	var services []*msg.Service
+	if err := json.NewDecoder(r).Decode(&services); err != nil {
+		errs[""] = err
+		return errs
+	}
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		done int
+		work = make(chan *msg.Service)
+	)
+	finish := func(uuid string, err error) {
+		mu.Lock()
+		if err != nil {
+			errs[uuid] = err
+		}
+		done++
+		n := done
+		mu.Unlock()
+		if opts.Progress != nil {
+			opts.Progress(n, len(services))
+		}
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range work {
+				var err error
+				if opts.Resume {
+					_, err = c.add(ctx, s.UUID, s, false)
+					if errors.Is(err, ErrConflictingUUID) {
+						err = nil
+					}
+				} else {
+					err = c.AddContext(ctx, s.UUID, s)
+				}
+				finish(s.UUID, err)
+			}
+		}()
+	}
+	for _, s := range services {
+		switch {
+		case s == nil:
+			finish("", nil)
+		case s.UUID == "":
+			finish("", ErrNoUUID)
+		case ctx.Err() != nil:
+			finish(s.UUID, ctx.Err())
+		default:
+			select {
+			case work <- s:
+			case <-ctx.Done():
+				finish(s.UUID, ctx.Err())
+			}
+		}
+	}
+	close(work)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"time"
+)
+
+// A Query is a DNS query of QueryBatch, for Name relative to the client's
+// domain, as with Client.Query, and type Type.
+type Query struct {
+	Name string
+	Type uint16
+}
+
+// QueryBatch sends queries and returns their replies and errors, both in the
+// order of queries. With WithDNSOverTCP the queries are pipelined over a
+// single TCP connection, and are not retried; a connection that fails fails
+// the queries not answered yet. Without a deadline on ctx, all replies must
+// arrive within the timeout of the DNS client. Otherwise each query is
+// exchanged on its own, as by QueryContext.
+func (c *Client) QueryBatch(ctx context.Context, queries []Query) ([]*dns.Msg, []error) {
+	replies := make([]*dns.Msg, len(queries))
+	errs := make([]error, len(queries))
+	if !c.dnsTCP || c.doh != "" {
+		for i, q := range queries {
+			replies[i], errs[i] = c.QueryContext(ctx, q.Name, q.Type)
+		}
+		return replies, errs
+	}
+
+	// Pending queries by their ID, which the replies carry.
+	pending := make(map[uint16]int, len(queries))
+	msgs := make([]*dns.Msg, 0, len(queries))
+	for i, q := range queries {
+		m, err := c.newRequestDNS(q.Name, q.Type)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		for _, ok := pending[m.Id]; ok; _, ok = pending[m.Id] {
+			m.Id = dns.Id()
+		}
+		pending[m.Id] = i
+		msgs = append(msgs, m)
+	}
+	// The packed queries by ID, kept for the wire tap.
+	var sent map[uint16][]byte
+	if c.wireTap != nil {
+		sent = make(map[uint16][]byte, len(msgs))
+	}
+	fail := func(err error) ([]*dns.Msg, []error) {
+		for id, i := range pending {
+			errs[i] = err
+			atomic.AddInt64(&c.stats.dnsErrors, 1)
+			if b, ok := sent[id]; ok {
+				c.wireTap(b, nil)
+			}
+		}
+		return replies, errs
+	}
+	if len(msgs) == 0 {
+		return replies, errs
+	}
+
+	if callCtx, cancel := c.callContext(ctx); cancel != nil {
+		ctx = callCtx
+		defer cancel()
+	}
+	atomic.AddInt64(&c.stats.dnsQueries, int64(len(msgs)))
+	conn, err := c.tcpClient().DialContext(ctx, c.basedns)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		timeout := c.d.Timeout
+		if timeout == 0 {
+			timeout = dnsTimeout
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetDeadline(deadline)
+	// Unblock the reads below when ctx is canceled.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	for _, m := range msgs {
+		if c.wireTap == nil {
+			err = conn.WriteMsg(m)
+		} else if sent[m.Id], err = m.Pack(); err == nil {
+			_, err = conn.Write(sent[m.Id])
+		}
+		if err != nil {
+			return fail(ctxErr(ctx, err))
+		}
+	}
+	var buf []byte
+	if c.wireTap != nil {
+		buf = make([]byte, dns.MaxMsgSize)
+	}
+	for len(pending) > 0 {
+		r, err := c.readBatchReply(conn, buf, sent)
+		if err != nil {
+			return fail(ctxErr(ctx, err))
+		}
+		i, ok := pending[r.Id]
+		if !ok {
+			continue
+		}
+		delete(pending, r.Id)
+		replies[i] = r
+	}
+	return replies, errs
+}
+
+// readBatchReply reads the next reply from conn, into buf and passing it to
+// the wire tap, along with the query in sent it answers, if there is one.
+func (c *Client) readBatchReply(conn *dns.Conn, buf []byte, sent map[uint16][]byte) (*dns.Msg, error) {
+	if c.wireTap == nil {
+		return conn.ReadMsg()
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	if b, ok := sent[r.Id]; ok {
+		delete(sent, r.Id)
+		c.wireTap(b, buf[:n])
+	}
+	return r, nil
+}
+
+// ctxErr returns the error of ctx if it is done, err otherwise.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -6,23 +6,76 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/skynetservices/skydns1/msg"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	ErrNoHttpAddress   = errors.New("No HTTP address specified")
-	ErrNoDnsAddress    = errors.New("No DNS address specified")
-	ErrInvalidResponse = errors.New("Invalid HTTP response")
-	ErrServiceNotFound = errors.New("Service not found")
-	ErrConflictingUUID = errors.New("Conflicting UUID")
+	ErrNoHttpAddress      = errors.New("No HTTP address specified")
+	ErrNoDnsAddress       = errors.New("No DNS address specified")
+	ErrInvalidResponse    = errors.New("Invalid HTTP response")
+	ErrServiceNotFound    = errors.New("Service not found")
+	ErrConflictingUUID    = errors.New("Conflicting UUID")
+	ErrNoFields           = errors.New("No fields specified")
+	ErrUnknownField       = errors.New("Unknown service field")
+	ErrInvalidDialer      = errors.New("Invalid DNS dialer")
+	ErrNoLeader           = errors.New("No leader found")
+	ErrTooManyRedirects   = errors.New("Too many redirects")
+	ErrCrossHostRedirect  = errors.New("Redirect to another host")
+	ErrNoHost             = errors.New("No host specified")
+	ErrNoPort             = errors.New("No port specified")
+	ErrNoSecret           = errors.New("No secret specified")
+	ErrInvalidTTL         = errors.New("Invalid TTL")
+	ErrInvalidInterval    = errors.New("Invalid interval")
+	ErrInvalidRateLimit   = errors.New("Invalid rate limit")
+	ErrInvalidHTTPClient  = errors.New("Invalid HTTP client")
+	ErrNotTransport       = errors.New("HTTP client transport is not an *http.Transport")
+	ErrInvalidTransport   = errors.New("Invalid HTTP transport")
+	ErrInvalidPath        = errors.New("Invalid path")
+	ErrInvalidJitter      = errors.New("Invalid jitter")
+	ErrInvalidRetries     = errors.New("Invalid number of retries")
+	ErrInvalidKeyFunc     = errors.New("Invalid key function")
+	ErrNoUUID             = errors.New("Service has no UUID")
+	ErrInvalidEndpoints   = errors.New("Invalid endpoints")
+	ErrInvalidName        = errors.New("Invalid SkyDNS name")
+	ErrUnreachable        = errors.New("Server unreachable")
+	ErrUnauthorized       = errors.New("Unauthorized")
+	ErrServerError        = errors.New("Server error")
+	ErrInvalidExpiry      = errors.New("Expiry is not in the future")
+	ErrHeartbeatTooSlow   = errors.New("Heartbeat interval is not shorter than the TTL")
+	ErrPayloadTooLarge    = errors.New("Payload too large")
+	ErrNotJSON            = errors.New("Response is not JSON")
+	ErrDecode             = errors.New("Malformed JSON in response")
+	ErrNoRegions          = errors.New("No regions")
+	ErrInvalidLimit       = errors.New("Invalid concurrency limit")
+	ErrInvalidDoH         = errors.New("Invalid DoH endpoint")
+	ErrInvalidSubnet      = errors.New("Invalid client subnet")
+	ErrInvalidDNSServer   = errors.New("Invalid DNS server address")
+	ErrInvalidCallback    = errors.New("Invalid callback")
+	ErrNotSupported       = errors.New("Not supported by the server")
+	ErrInvalidFamily      = errors.New("Invalid address family")
+	ErrPreconditionFailed = errors.New("Service does not match the expected one")
+	ErrInvalidMediaType   = errors.New("Media type is not JSON")
 )
 
 type (
@@ -34,42 +87,328 @@ type (
 		domain  string
 		d       *dns.Client
 		DNS     bool // if true use the DNS when listing servies
+
+		compress      bool // gzip large request bodies
+		streamAdd     bool // encode Add bodies while they are sent
+		checkConflict bool // on a conflicting Add, compare with the existing service
+		checkCallback bool // connect to a callback's reply address in AddCallback
+		followLeader  bool // send mutating requests to the raft leader
+		leader        *leaderState
+		endpoints     *endpointSet // read requests are spread over these
+
+		crossHostRedirects bool // follow redirects to other hosts
+		deleteIdempotent   bool // a Delete of a missing service succeeds
+		forceConflict      bool // on a conflicting Add, replace a differing service
+		requireAuth        bool // a secret must be given
+		rawDomain          bool // use the domain as given in DNS names
+		dnsTCP             bool // send DNS queries over TCP only
+		idempotencyKeys    bool // send an Idempotency-Key with every Add
+		family             AddressFamily
+		lenient            bool // accept numeric service fields as strings
+		warmup             bool // connect to the server in NewClient
+		observer           Observer
+		strict             bool // reject unknown fields when decoding
+		limiter            *rate.Limiter
+		callbacksPath      string  // path of the callbacks collection, ends in a slash
+		jitter             float64 // default heartbeat jitter
+		dnsRetries         int     // times to retry a failed DNS query
+		doh                string  // DoH endpoint DNS queries are sent to, if set
+		httpRetries        int     // times to retry a failed read request
+		backoff            Backoff // wait between retries, none if nil
+		dnsFlight          *singleflight.Group
+		httpFlight         *singleflight.Group
+		ecs                *dns.EDNS0_SUBNET // client subnet sent with DNS queries
+		headers            http.Header       // set on every HTTP request
+		accept             string            // Accept header, JSON if empty
+		ctx                context.Context   // parent of every call, if set
+		sem                chan struct{}     // bounds the requests in flight
+		wireTap            func(sent, received []byte)
+		dnsConn            *dnsConn // persistent connection to the DNS server
+		key                func(*msg.Service) string
+		stats              *clientStats
 	}
 
 	NameCount map[string]int
 )
 
+// defaultJitter is the default fraction by which heartbeat intervals vary.
+const defaultJitter = 0.1
+
+// warmupTimeout bounds the warmup request made by NewClient.
+const warmupTimeout = 5 * time.Second
+
+// ednsUDPSize is the UDP payload size advertised in queries that carry EDNS
+// options.
+const ednsUDPSize = 4096
+
+// idempotencyKeyHeader is the request header carrying the idempotency key of
+// an Add.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// userAgent is the User-Agent of every HTTP request the client makes, unless
+// one is set with WithHeaders or WithRequestHeaders.
+const userAgent = "skydns-client"
+
+// gzipThreshold is the size in bytes above which request bodies are
+// compressed when request compression is enabled.
+const gzipThreshold = 1024
+
 // NewClient creates a new skydns client with the specificed host address and
-// DNS port.
-func NewClient(base, secret, domain, basedns string) (*Client, error) {
+// DNS port. The options, if any, are applied in order.
+func NewClient(base, secret, domain, basedns string, opts ...Option) (*Client, error) {
 	if base == "" {
 		return nil, ErrNoHttpAddress
 	}
 	if basedns == "" {
 		return nil, ErrNoDnsAddress
 	}
-	return &Client{
+	c := &Client{
 		base:    base,
 		basedns: basedns,
-		domain:  dns.Fqdn(domain),
+		domain:  domain,
 		secret:  secret,
 		h:       &http.Client{},
 		d:       &dns.Client{},
-	}, nil
+		stats:   &clientStats{},
+		leader:  &leaderState{},
+
+		callbacksPath: "/skydns/callbacks/",
+		jitter:        defaultJitter,
+		key:           serviceUUID,
+	}
+	c.h.CheckRedirect = c.checkRedirect
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if !c.rawDomain {
+		c.domain = dns.Fqdn(c.domain)
+	}
+	if c.requireAuth && c.secret == "" {
+		return nil, ErrNoSecret
+	}
+	if c.warmup {
+		ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+		err := c.Warmup(ctx)
+		cancel()
+		if err != nil {
+			if c.requireAuth {
+				return nil, err
+			}
+			log.Printf("skydns: warmup failed: %s", err)
+		}
+	}
+	return c, nil
+}
+
+// ForDomain returns a shallow copy of the client that queries the DNS domain
+// domain instead of the client's own. The HTTP and DNS clients are shared with
+// the original.
+func (c *Client) ForDomain(domain string) *Client {
+	n := *c
+	n.domain = domain
+	if !c.rawDomain {
+		n.domain = dns.Fqdn(domain)
+	}
+	return &n
+}
+
+// ForDNSServer returns a shallow copy of the client that sends its DNS
+// queries to server, a host:port address, instead of the client's own DNS
+// server, or its DoH endpoint. All DNS methods of the copy, like GetDNS and
+// LookupPrefix, use server; the original is unchanged. With
+// WithPersistentDNSConn the copy has a connection of its own.
+func (c *Client) ForDNSServer(server string) (*Client, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || host == "" {
+		return nil, ErrInvalidDNSServer
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return nil, ErrInvalidDNSServer
+	}
+	n := *c
+	n.basedns = server
+	n.doh = ""
+	if c.dnsConn != nil {
+		n.dnsConn = &dnsConn{}
+	}
+	return &n, nil
 }
 
 func (c *Client) Add(uuid string, s *msg.Service) error {
-	b := bytes.NewBuffer(nil)
-	if err := json.NewEncoder(b).Encode(s); err != nil {
+	return c.AddContext(context.Background(), uuid, s)
+}
+
+// AddContext is like Add, but the request is bound to ctx.
+func (c *Client) AddContext(ctx context.Context, uuid string, s *msg.Service) error {
+	if c.forceConflict {
+		_, err := c.addForce(ctx, uuid, s)
 		return err
 	}
-	req, err := c.newRequest("PUT", c.joinUrl(uuid), b)
-	if err != nil {
+	_, err := c.add(ctx, uuid, s, c.checkConflict)
+	return err
+}
+
+// AddAndWait adds s under uuid and then polls Get every poll interval until
+// the service is visible, so a read that follows sees the write even when it
+// is served by a lagging follower. An error of the Add is returned right
+// away. If ctx expires first, the last error of Get other than
+// ErrServiceNotFound is returned, or the context's error. A poll interval of
+// zero or less returns ErrInvalidInterval without adding s.
+func (c *Client) AddAndWait(ctx context.Context, uuid string, s *msg.Service, poll time.Duration) error {
+	if poll <= 0 {
+		return ErrInvalidInterval
+	}
+	if err := c.AddContext(ctx, uuid, s); err != nil {
 		return err
 	}
-	resp, err := c.h.Do(req)
+	tick := time.NewTicker(poll)
+	defer tick.Stop()
+
+	var last error
+	for {
+		_, err := c.GetContext(ctx, uuid)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrServiceNotFound) && ctx.Err() == nil {
+			last = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if last != nil {
+				return last
+			}
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// AddWithOverwrite is like Add with WithForceOnConflict set, whether or not
+// the client has it, and reports whether a different service registered
+// under uuid was overwritten.
+func (c *Client) AddWithOverwrite(uuid string, s *msg.Service) (bool, error) {
+	return c.addForce(context.Background(), uuid, s)
+}
+
+// addForce adds s under uuid and, if a different service is registered under
+// it, deletes that one and adds s again. It reports whether it did so.
+func (c *Client) addForce(ctx context.Context, uuid string, s *msg.Service) (bool, error) {
+	_, err := c.add(ctx, uuid, s, true)
+	switch {
+	case errors.Is(err, ErrServiceNotFound):
+		// The conflicting service went away before it could be compared.
+	case !errors.Is(err, ErrConflictingUUID):
+		return false, err
+	}
+	if _, err := c.del(ctx, uuid); err != nil && !errors.Is(err, ErrServiceNotFound) {
+		return false, err
+	}
+	if _, err := c.add(ctx, uuid, s, false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AddWithTTL adds s under uuid with its TTL set to ttl. s itself is not
+// changed.
+func (c *Client) AddWithTTL(uuid string, s *msg.Service, ttl uint32) error {
+	if ttl == 0 {
+		return ErrInvalidTTL
+	}
+	n := *s
+	n.TTL = ttl
+	return c.Add(uuid, &n)
+}
+
+// AddWithExpiry is like AddWithTTL, but the service expires at the time at,
+// which must be in the future. The server takes no expiry time, so at is
+// turned into a TTL, rounded up to whole seconds, when the request is made.
+func (c *Client) AddWithExpiry(uuid string, s *msg.Service, at time.Time) error {
+	d := time.Until(at)
+	if d <= 0 {
+		return ErrInvalidExpiry
+	}
+	return c.AddWithTTL(uuid, s, uint32((d+time.Second-1)/time.Second))
+}
+
+// AddWithResponse is like Add, but also returns the headers of the server's
+// response.
+func (c *Client) AddWithResponse(uuid string, s *msg.Service) (http.Header, error) {
+	return c.add(context.Background(), uuid, s, c.checkConflict)
+}
+
+// AddIfNotExists adds the service s under uuid only if uuid is not yet
+// registered. It reports whether the service was created; an existing
+// registration is left untouched and is not an error. Unlike a Get followed
+// by an Add this takes a single round trip, so it cannot race other writers.
+func (c *Client) AddIfNotExists(uuid string, s *msg.Service) (bool, error) {
+	_, err := c.add(context.Background(), uuid, s, false)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrConflictingUUID):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// AddMultiRegion adds s once for every region in regions, with its Region set
+// to that region and under the UUID <baseUUID>-<region>, as a UUID is a
+// single DNS label. It returns the error of each region's Add, nil ones
+// included, keyed by region. The error is only set when nothing was added
+// because baseUUID or regions are invalid.
+func (c *Client) AddMultiRegion(baseUUID string, s *msg.Service, regions []string) (map[string]error, error) {
+	if baseUUID == "" || strings.Contains(baseUUID, ".") {
+		return nil, ErrInvalidName
+	}
+	if len(regions) == 0 {
+		return nil, ErrNoRegions
+	}
+	for _, r := range regions {
+		if r == "" || strings.Contains(r, ".") {
+			return nil, fmt.Errorf("%w: region %q", ErrInvalidName, r)
+		}
+	}
+	errs := make(map[string]error, len(regions))
+	for _, r := range regions {
+		n := *s
+		n.Region = r
+		n.UUID = RegionUUID(baseUUID, r)
+		errs[r] = c.Add(n.UUID, &n)
+	}
+	return errs, nil
+}
+
+// RegionUUID returns the UUID AddMultiRegion registers the copy of baseUUID
+// in region under.
+func RegionUUID(baseUUID, region string) string {
+	return baseUUID + "-" + strings.ToLower(region)
+}
+
+// add registers s under uuid. If check is set a conflict is only reported
+// when the existing service differs from s.
+func (c *Client) add(ctx context.Context, uuid string, s *msg.Service, check bool) (http.Header, error) {
+	newRequest := c.newJSONRequest
+	if c.streamAdd {
+		newRequest = c.newStreamingJSONRequest
+	}
+	req, err := newRequest(ctx, "PUT", c.joinUrl(uuid), s)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// Ends the encoding if the request fails before its body is read.
+	defer req.Body.Close()
+	if c.idempotencyKeys {
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey(ctx, uuid, s))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
 	}
 	if resp.Body != nil {
 		defer resp.Body.Close()
@@ -77,42 +416,249 @@ func (c *Client) Add(uuid string, s *msg.Service) error {
 
 	switch resp.StatusCode {
 	case http.StatusCreated:
-		return nil
+		return resp.Header, nil
 	case http.StatusConflict:
-		return ErrConflictingUUID
+		if check {
+			return resp.Header, c.compareExisting(ctx, uuid, s)
+		}
+		return resp.Header, newHTTPError(resp, ErrConflictingUUID)
 	case http.StatusMovedPermanently:
 		base, err := c.extractBaseFromLocation(resp.Header.Get("Location"))
 		if err != nil {
-			return err
+			return resp.Header, err
 		}
 		c.base = base
-		return c.Add(uuid, s)
+		return c.add(ctx, uuid, s, check)
+	case http.StatusRequestEntityTooLarge:
+		return resp.Header, newHTTPError(resp, ErrPayloadTooLarge)
 	default:
-		return ErrInvalidResponse
+		return resp.Header, newHTTPError(resp, ErrInvalidResponse)
 	}
 }
 
-func (c *Client) Delete(uuid string) error {
-	req, err := c.newRequest("DELETE", c.joinUrl(uuid), nil)
+// compareExisting fetches the service registered under uuid and returns nil if
+// it is the same as s, ErrConflictingUUID if it is not.
+func (c *Client) compareExisting(ctx context.Context, uuid string, s *msg.Service) error {
+	e, err := c.GetContext(ctx, uuid)
 	if err != nil {
 		return err
 	}
-	resp, err := c.h.Do(req)
+	if !sameService(e, s) {
+		return ErrConflictingUUID
+	}
+	return nil
+}
+
+// sameService reports whether a and b describe the same service, as by
+// ServiceEqual but ignoring the TTL, which the server reports as the time
+// remaining.
+func sameService(a, b *msg.Service) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	n := *b
+	n.TTL = a.TTL
+	return ServiceEqual(a, &n)
+}
+
+// Delete removes the service registered under uuid. It returns
+// ErrServiceNotFound if there is none, unless WithDeleteIdempotent is set.
+func (c *Client) Delete(uuid string) error {
+	return c.DeleteContext(context.Background(), uuid)
+}
+
+// DeleteContext is like Delete, but the request is bound to ctx.
+func (c *Client) DeleteContext(ctx context.Context, uuid string) error {
+	_, err := c.del(ctx, uuid)
+	return err
+}
+
+// DeleteWithResponse is like Delete, but also returns the headers of the
+// server's response.
+func (c *Client) DeleteWithResponse(uuid string) (http.Header, error) {
+	return c.del(context.Background(), uuid)
+}
+
+// DeleteIfMatch deletes the service registered under uuid only if it is
+// equal to expected by ServiceEqual, ignoring the TTL as the server reports
+// the time remaining, and returns ErrPreconditionFailed if it is not, for
+// instance because another controller registered a different service under
+// uuid. The server cannot delete conditionally, so a change
+// between the check and the delete still goes unnoticed.
+func (c *Client) DeleteIfMatch(uuid string, expected *msg.Service) error {
+	return c.DeleteIfMatchContext(context.Background(), uuid, expected)
+}
+
+// DeleteIfMatchContext is like DeleteIfMatch, but the requests are bound to
+// ctx.
+func (c *Client) DeleteIfMatchContext(ctx context.Context, uuid string, expected *msg.Service) error {
+	s, err := c.GetContext(ctx, uuid)
 	if err != nil {
 		return err
 	}
+	if !sameService(s, expected) {
+		return ErrPreconditionFailed
+	}
+	return c.DeleteContext(ctx, uuid)
+}
+
+func (c *Client) del(ctx context.Context, uuid string) (http.Header, error) {
+	req, err := c.newRequestContext(ctx, "DELETE", c.joinUrl(uuid), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.Header, nil
+	case resp.StatusCode == http.StatusNotFound:
+		if c.deleteIdempotent {
+			return resp.Header, nil
+		}
+		return resp.Header, newHTTPError(resp, ErrServiceNotFound)
+	default:
+		return resp.Header, newHTTPError(resp, ErrInvalidResponse)
+	}
+}
+
+// deleteConcurrency is the number of requests DeleteWhere sends at a time.
+const deleteConcurrency = 4
+
+// DeleteWhere deletes every service for which pred returns true and reports
+// how many were deleted. A service that is already gone when it is deleted
+// is not counted, but is no error. On the first failed delete no further
+// ones are started and the error is returned along with the count so far.
+func (c *Client) DeleteWhere(pred func(*msg.Service) bool) (int, error) {
+	return c.DeleteWhereContext(context.Background(), pred, deleteConcurrency)
+}
+
+// DeleteWhereContext is like DeleteWhere, using up to concurrency requests
+// at a time. When ctx is done no more services are deleted and its error is
+// returned with the count so far.
+func (c *Client) DeleteWhereContext(ctx context.Context, pred func(*msg.Service) bool, concurrency int) (int, error) {
+	services, err := c.GetAllServicesContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		n     int
+		first error
+		work  = make(chan string)
+		stop  = make(chan struct{})
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uuid := range work {
+				_, err := c.del(ctx, uuid)
+				mu.Lock()
+				switch {
+				case err == nil:
+					n++
+				case errors.Is(err, ErrServiceNotFound):
+				case first == nil:
+					first = err
+					close(stop)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	var cancelled error
+	for _, s := range services {
+		if s == nil || !pred(s) {
+			continue
+		}
+		uuid := c.key(s)
+		if uuid == "" {
+			continue
+		}
+		select {
+		case work <- uuid:
+			continue
+		case <-stop:
+		case <-ctx.Done():
+			cancelled = ctx.Err()
+		}
+		break
+	}
+	close(work)
+	wg.Wait()
+
+	if first == nil {
+		first = cancelled
+	}
+	return n, first
+}
+
+// Rename moves the service registered under oldUUID to newUUID without a
+// moment in which neither is registered: the service is added under
+// newUUID and oldUUID is only deleted once the new registration can be
+// fetched. If newUUID is already taken by a different service
+// ErrConflictingUUID is returned; when it holds the same service, as after
+// an interrupted Rename, the rename carries on. On failure the new
+// registration is removed again, leaving the old one in place.
+func (c *Client) Rename(oldUUID, newUUID string) error {
+	ctx := context.Background()
+	s, err := c.GetContext(ctx, oldUUID)
+	if err != nil {
+		return err
+	}
+	n := *s
+	n.UUID = newUUID
+	if _, err := c.add(ctx, newUUID, &n, true); err != nil {
+		return err
+	}
+	if _, err := c.GetContext(ctx, newUUID); err != nil {
+		c.DeleteContext(ctx, newUUID)
+		return err
+	}
+	if err := c.DeleteContext(ctx, oldUUID); err != nil && !errors.Is(err, ErrServiceNotFound) {
+		c.DeleteContext(ctx, newUUID)
+		return err
+	}
 	return nil
 }
 
 func (c *Client) Get(uuid string) (*msg.Service, error) {
-	req, err := c.newRequest("GET", c.joinUrl(uuid), nil)
+	return c.GetContext(context.Background(), uuid)
+}
+
+// GetContext is like Get, but the request is bound to ctx.
+func (c *Client) GetContext(ctx context.Context, uuid string) (*msg.Service, error) {
+	u := c.joinUrl(uuid)
+	v, err := c.coalesce(ctx, u, func(ctx context.Context) (interface{}, error) {
+		return c.get(ctx, u)
+	})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.h.Do(req)
+	if c.httpFlight == nil {
+		return v.(*msg.Service), nil
+	}
+	return copyService(v.(*msg.Service)), nil
+}
+
+func (c *Client) get(ctx context.Context, u string) (*msg.Service, error) {
+	req, err := c.newRequestContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -123,62 +669,169 @@ func (c *Client) Get(uuid string) (*msg.Service, error) {
 	case http.StatusOK:
 		break
 	case http.StatusNotFound:
-		return nil, ErrServiceNotFound
+		return nil, newHTTPError(resp, ErrServiceNotFound)
 	default:
-		return nil, ErrInvalidResponse
+		return nil, newHTTPError(resp, ErrInvalidResponse)
 	}
 
+	if err := checkContentType(resp); err != nil {
+		return nil, err
+	}
 	var s *msg.Service
-	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+	if err := c.decode(resp.Body, &s); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
+// GetTTL returns the remaining TTL of the service with uuid. The SkyDNS
+// server has no lighter endpoint for this, so the service is fetched with Get.
+func (c *Client) GetTTL(uuid string) (uint32, error) {
+	s, err := c.Get(uuid)
+	if err != nil {
+		return 0, err
+	}
+	return s.TTL, nil
+}
+
+// Update sets the TTL of the service with uuid to ttl.
 func (c *Client) Update(uuid string, ttl uint32) error {
-	b := bytes.NewBuffer([]byte(fmt.Sprintf(`{"TTL":%d}`, ttl)))
-	req, err := c.newRequest("PATCH", c.joinUrl(uuid), b)
+	return c.UpdateContext(context.Background(), uuid, ttl)
+}
+
+// UpdateContext is like Update, but the request is bound to ctx.
+func (c *Client) UpdateContext(ctx context.Context, uuid string, ttl uint32) error {
+	_, _, err := c.update(ctx, uuid, ttl)
+	return err
+}
+
+// UpdateWithResponse is like Update, but also returns the headers of the
+// server's response.
+func (c *Client) UpdateWithResponse(uuid string, ttl uint32) (http.Header, error) {
+	h, _, err := c.update(context.Background(), uuid, ttl)
+	return h, err
+}
+
+// UpdateEffective is like Update, but returns the TTL the server applied,
+// which may differ from ttl if the server clamps TTLs. When the server does
+// not report the TTL in its response, as when the body is empty or not JSON,
+// ttl is returned.
+func (c *Client) UpdateEffective(uuid string, ttl uint32) (uint32, error) {
+	_, effective, err := c.update(context.Background(), uuid, ttl)
+	return effective, err
+}
+
+func (c *Client) update(ctx context.Context, uuid string, ttl uint32) (http.Header, uint32, error) {
+	req, err := c.newJSONRequest(ctx, "PATCH", c.joinUrl(uuid), map[string]uint32{ttlField: ttl})
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
-	return nil
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusNotFound:
+		return resp.Header, 0, newHTTPError(resp, ErrServiceNotFound)
+	default:
+		return resp.Header, 0, newHTTPError(resp, ErrInvalidResponse)
+	}
+
+	// The update succeeded, a body that is empty or not a service, like
+	// "OK", reports nothing and ttl was applied.
+	var s msg.Service
+	if err := c.decode(resp.Body, &s); err != nil || s.TTL == 0 {
+		return resp.Header, ttl, nil
+	}
+	return resp.Header, s.TTL, nil
 }
 
-func (c *Client) GetAllServices() ([]*msg.Service, error) {
-	req, err := c.newRequest("GET", c.joinUrl(""), nil)
+// PatchService changes only the given fields of the service with uuid. The
+// keys of fields are the JSON names of the msg.Service fields. Note that the
+// SkyDNS server itself only applies changes to the TTL.
+func (c *Client) PatchService(uuid string, fields map[string]interface{}) error {
+	return c.PatchServiceContext(context.Background(), uuid, fields)
+}
+
+// PatchServiceContext is like PatchService, but the request is bound to ctx.
+func (c *Client) PatchServiceContext(ctx context.Context, uuid string, fields map[string]interface{}) error {
+	if len(fields) == 0 {
+		return ErrNoFields
+	}
+	for k := range fields {
+		if !serviceFields[k] {
+			return fmt.Errorf("%w: %q", ErrUnknownField, k)
+		}
+	}
+	req, err := c.newJSONRequest(ctx, "PATCH", c.joinUrl(uuid), fields)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
 
-	var out []*msg.Service
-	if resp.StatusCode == http.StatusOK {
-		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-			return nil, err
-		}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return newHTTPError(resp, ErrServiceNotFound)
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return newHTTPError(resp, ErrPayloadTooLarge)
+	default:
+		return newHTTPError(resp, ErrInvalidResponse)
+	}
+}
+
+// GetAllServices returns all registered services. On success the slice is
+// never nil, so it is empty when there are no services. The same holds for
+// the filtered and grouped variants, and for the maps of GetRegions and
+// GetEnvironments.
+func (c *Client) GetAllServices() ([]*msg.Service, error) {
+	return c.GetAllServicesContext(context.Background())
+}
+
+// GetAllServicesContext is like GetAllServices, but the request is bound to
+// ctx.
+func (c *Client) GetAllServicesContext(ctx context.Context) ([]*msg.Service, error) {
+	u := c.joinUrl("")
+	v, err := c.coalesce(ctx, u, func(ctx context.Context) (interface{}, error) {
+		return c.getAll(ctx, u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	services := v.([]*msg.Service)
+	if c.httpFlight == nil {
+		return services, nil
+	}
+	out := make([]*msg.Service, len(services))
+	for i, s := range services {
+		out[i] = copyService(s)
 	}
 	return out, nil
 }
 
-func (c *Client) GetAllServicesDNS() ([]*msg.Service, error) {
-	req, err := c.newRequestDNS("", dns.TypeSRV)
+func (c *Client) getAll(ctx context.Context, u string) ([]*msg.Service, error) {
+	req, err := c.newRequestContext(ctx, "GET", u, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, _, err := c.d.Exchange(req, c.basedns)
+	services, _, err := c.list(req)
+	return services, err
+}
+
+func (c *Client) GetAllServicesDNS() ([]*msg.Service, error) {
+	resp, err := c.Query("", dns.TypeSRV)
 	if err != nil {
 		return nil, err
 	}
@@ -199,55 +852,92 @@ func (c *Client) GetAllServicesDNS() ([]*msg.Service, error) {
 }
 
 func (c *Client) GetRegions() (NameCount, error) {
-	req, err := c.newRequest("GET", fmt.Sprintf("%s/skydns/regions/", c.base), nil)
+	return c.GetRegionsContext(context.Background())
+}
+
+// GetRegionsContext is like GetRegions, but the request is bound to ctx.
+func (c *Client) GetRegionsContext(ctx context.Context) (NameCount, error) {
+	req, err := c.newRequestContext(ctx, "GET", fmt.Sprintf("%s/skydns/regions/", c.base), nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPError(resp, ErrInvalidResponse)
+	}
 
 	var out NameCount
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+	if err := c.decode(resp.Body, &out); err != nil {
 		return nil, err
 	}
+	if out == nil {
+		out = make(NameCount)
+	}
 	return out, nil
 }
 
 func (c *Client) GetEnvironments() (NameCount, error) {
-	req, err := c.newRequest("GET", fmt.Sprintf("%s/skydns/environments/", c.base), nil)
+	return c.GetEnvironmentsContext(context.Background())
+}
+
+// GetEnvironmentsContext is like GetEnvironments, but the request is bound to ctx.
+func (c *Client) GetEnvironmentsContext(ctx context.Context) (NameCount, error) {
+	req, err := c.newRequestContext(ctx, "GET", fmt.Sprintf("%s/skydns/environments/", c.base), nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPError(resp, ErrInvalidResponse)
+	}
 
 	var out NameCount
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+	if err := c.decode(resp.Body, &out); err != nil {
 		return nil, err
 	}
+	if out == nil {
+		out = make(NameCount)
+	}
 	return out, nil
 }
 
-func (c *Client) AddCallback(uuid string, cb *msg.Callback) error {
-	buf := bytes.NewBuffer(nil)
-	if err := json.NewEncoder(buf).Encode(cb); err != nil {
+// AddCallback registers the callback cb for the service uuid. The options
+// are applied to the request, for instance to add headers with WithHeader.
+// An unexpected status is returned as an *HTTPError.
+func (c *Client) AddCallback(uuid string, cb *msg.Callback, opts ...RequestOption) error {
+	return c.AddCallbackContext(context.Background(), uuid, cb, opts...)
+}
+
+// AddCallbackContext is like AddCallback, but the request is bound to ctx.
+func (c *Client) AddCallbackContext(ctx context.Context, uuid string, cb *msg.Callback, opts ...RequestOption) error {
+	if err := ValidateCallback(cb); err != nil {
 		return err
 	}
-	req, err := c.newRequest("PUT", fmt.Sprintf("%s/skydns/callbacks/%s", c.base, uuid), buf)
+	if c.checkCallback {
+		if err := dialCallback(ctx, cb); err != nil {
+			return err
+		}
+	}
+	req, err := c.newJSONRequest(ctx, "PUT", c.callbackUrl(uuid), cb)
 	if err != nil {
 		return err
 	}
-	resp, err := c.h.Do(req)
+	for _, opt := range opts {
+		opt(req)
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -257,24 +947,511 @@ func (c *Client) AddCallback(uuid string, cb *msg.Callback) error {
 
 	switch resp.StatusCode {
 	case http.StatusCreated:
-		return nil
+		err = nil
 	case http.StatusNotFound:
-		return ErrServiceNotFound
+		err = newHTTPError(resp, ErrServiceNotFound)
+	case http.StatusRequestEntityTooLarge:
+		err = newHTTPError(resp, ErrPayloadTooLarge)
 	default:
-		return ErrInvalidResponse
+		err = newHTTPError(resp, ErrInvalidResponse)
+	}
+	// Drain the body so the connection can be reused.
+	io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// callbackDialTimeout bounds the connection attempt of WithCallbackCheck.
+const callbackDialTimeout = 2 * time.Second
+
+// dialCallback connects to the reply address of cb, which must be valid.
+func dialCallback(ctx context.Context, cb *msg.Callback) error {
+	addr := net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(cb.Reply, "["), "]"), strconv.Itoa(int(cb.Port)))
+	d := net.Dialer{Timeout: callbackDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("%w: reply %s unreachable: %w", ErrInvalidCallback, addr, err)
+	}
+	return conn.Close()
+}
+
+// coalesce calls fn, or with WithSingleflight waits for the result of a
+// running call for the same key made with the same headers, so callers with
+// another secret or other headers from WithRequestHeaders never share a
+// response. The shared call is not canceled when the caller that started it
+// goes away, each caller waits for it as long as its own ctx allows.
+func (c *Client) coalesce(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	if c.httpFlight == nil {
+		return fn(ctx)
+	}
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteString("\n")
+	c.requestHeader(ctx).Write(&b)
+	ch := c.httpFlight.DoChan(b.String(), func() (interface{}, error) {
+		return fn(context.WithoutCancel(ctx))
+	})
+	select {
+	case res := <-ch:
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// copyService returns a copy of s that shares no maps with it, so callers
+// handed the result of a shared request cannot see each other's changes.
+func copyService(s *msg.Service) *msg.Service {
+	if s == nil {
+		return nil
+	}
+	n := *s
+	if s.Metadata != nil {
+		n.Metadata = make(map[string]string, len(s.Metadata))
+		for k, v := range s.Metadata {
+			n.Metadata[k] = v
+		}
+	}
+	return &n
+}
+
+// do sends an HTTP request, to the leader if the client follows it.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.followLeader && isWrite(req.Method) {
+		return c.doLeader(req)
 	}
+	send := c.send
+	if c.endpoints != nil && !isWrite(req.Method) {
+		send = c.doEndpoints
+	}
+	if c.httpRetries > 0 && !isWrite(req.Method) {
+		return c.doRetry(req, send)
+	}
+	return send(req)
+}
+
+// send sends an HTTP request and keeps the request counters. If the client is
+// rate limited, it first waits for its turn. A request whose connection is
+// reset is sent once more, see sendReset.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	ctx, cancel := c.callContext(req.Context())
+	if cancel == nil {
+		return c.sendReset(req)
+	}
+	resp, err := c.sendReset(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The deadline keeps applying while the caller reads the body.
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+func (c *Client) sendOnce(req *http.Request) (*http.Response, error) {
+	if c.limiter != nil {
+		if err := c.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	atomic.AddInt64(&c.stats.requests, 1)
+	atomic.AddInt64(&c.stats.inFlight, 1)
+	defer atomic.AddInt64(&c.stats.inFlight, -1)
+
+	start := time.Now()
+	resp, err := c.h.Do(req)
+	if err != nil {
+		atomic.AddInt64(&c.stats.errors, 1)
+	}
+	if c.observer != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		c.observer.ObserveRequest(req.Method, req.URL.Path, status, time.Since(start), err)
+	}
+	return resp, err
+}
+
+// checkRedirect is the CheckRedirect of the client's http.Client. Redirects
+// keep the Authorization header and, for mutating requests, the method and
+// body of the original request.
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	orig := via[0]
+	if c.followLeader && isWrite(orig.Method) {
+		// Let doLeader handle it.
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= 10 {
+		return ErrTooManyRedirects
+	}
+	crossHost := req.URL.Host != orig.URL.Host
+	if crossHost && isWrite(orig.Method) && req.Response != nil && req.Response.StatusCode == http.StatusMovedPermanently {
+		// The server's redirect to the leader, left to the caller.
+		return http.ErrUseLastResponse
+	}
+	if crossHost && !c.crossHostRedirects {
+		return ErrCrossHostRedirect
+	}
+	if isWrite(orig.Method) && req.Method != orig.Method {
+		// 301, 302 and 303 are turned into a GET, resend the original.
+		req.Method = orig.Method
+		req.Header = orig.Header.Clone()
+		req.ContentLength = orig.ContentLength
+		req.GetBody = orig.GetBody
+		req.Body = nil
+		if orig.GetBody != nil {
+			body, err := orig.GetBody()
+			if err != nil {
+				return err
+			}
+			req.Body = body
+		}
+	}
+	// Never send the secret to another host, net/http only compares the
+	// host names and keeps it for another port. On the same host the
+	// original's Authorization, which may be a per-call one, is kept.
+	switch auth := orig.Header.Values("Authorization"); {
+	case crossHost:
+		req.Header.Del("Authorization")
+	case len(auth) > 0:
+		req.Header["Authorization"] = append([]string(nil), auth...)
+	case c.secret != "":
+		req.Header.Set("Authorization", c.secret)
+	}
+	return nil
 }
 
 func (c *Client) joinUrl(uuid string) string {
 	return fmt.Sprintf("%s/skydns/services/%s", c.base, uuid)
 }
 
+func (c *Client) callbackUrl(uuid string) string {
+	return c.base + c.callbacksPath + uuid
+}
+
 func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
-	if c.secret != "" {
-		req.Header.Add("Authorization", c.secret)
+	return c.newRequestContext(context.Background(), method, url, body)
+}
+
+type timeoutKey struct{}
+
+// WithRequestTimeout returns a copy of ctx that bounds every HTTP request or
+// DNS query made with it to d, overriding the client's default for that call
+// only. A deadline already set on ctx still applies if it is earlier.
+func WithRequestTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, timeoutKey{}, d)
+}
+
+func requestTimeout(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(timeoutKey{}).(time.Duration)
+	return d, ok && d > 0
+}
+
+// callContext returns the context a call made with ctx runs in: bounded by
+// the timeout of WithRequestTimeout and done when the context given to
+// WithContext is. The CancelFunc is nil if ctx is returned as is.
+func (c *Client) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if c.ctx != nil {
+		var cancelCause context.CancelCauseFunc
+		ctx, cancelCause = context.WithCancelCause(ctx)
+		stop := context.AfterFunc(c.ctx, func() { cancelCause(context.Cause(c.ctx)) })
+		if c.ctx.Err() != nil {
+			cancelCause(context.Cause(c.ctx))
+		}
+		cancel = func() {
+			stop()
+			cancelCause(context.Canceled)
+		}
+	}
+	d, ok := requestTimeout(ctx)
+	if !ok {
+		return ctx, cancel
+	}
+	ctx, cancelTimeout := context.WithTimeout(ctx, d)
+	if cancel == nil {
+		return ctx, cancelTimeout
+	}
+	parent := cancel
+	return ctx, func() {
+		cancelTimeout()
+		parent()
+	}
+}
+
+type headersKey struct{}
+
+// WithRequestHeaders returns a copy of ctx that adds the headers in h to
+// every HTTP request made with it, on top of those set with WithHeaders, for
+// instance an Origin a server's CORS policy requires. An Authorization header
+// in h takes the place of the client's secret.
+func WithRequestHeaders(ctx context.Context, h http.Header) context.Context {
+	if prev, ok := ctx.Value(headersKey{}).(http.Header); ok {
+		m := prev.Clone()
+		setHeaders(m, h)
+		h = m
+	}
+	return context.WithValue(ctx, headersKey{}, h.Clone())
+}
+
+type idempotencyTokenKey struct{}
+
+// WithIdempotencyToken returns a copy of ctx that makes an Add with it, when
+// idempotency keys are enabled, derive its key from token and the UUID. Use
+// the same token when retrying an Add, and a new one for a new Add.
+func WithIdempotencyToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, idempotencyTokenKey{}, token)
+}
+
+// idempotencyKey returns the idempotency key for adding s under uuid: a hash
+// of the uuid and the token in ctx, or of the service if there is none.
+func idempotencyKey(ctx context.Context, uuid string, s *msg.Service) string {
+	token, ok := ctx.Value(idempotencyTokenKey{}).(string)
+	if !ok {
+		token = ServiceHash(s)
+	}
+	h := sha256.Sum256([]byte(uuid + "\x00" + token))
+	return hex.EncodeToString(h[:16])
+}
+
+// cancelBody releases the context of a request when its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Do sends a request with method to path, an absolute path on the server
+// such as /skydns/services/, and decodes the JSON response into out. It is an
+// escape hatch for endpoints the client does not wrap yet, and goes through
+// the same authentication, leader following, retries, limits and observer as
+// the other methods. A non-nil body is sent as JSON. The decoding is skipped
+// if out is nil or the response has no content. A status other than 2xx is
+// returned as an *HTTPError wrapping ErrInvalidResponse, or ErrPayloadTooLarge
+// for a 413; its StatusCode tells other statuses apart.
+func (c *Client) Do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	if !strings.HasPrefix(path, "/") {
+		return ErrInvalidPath
+	}
+	var (
+		req *http.Request
+		err error
+	)
+	if body != nil {
+		req, err = c.newJSONRequest(ctx, method, c.base+path, body)
+	} else {
+		req, err = c.newRequestContext(ctx, method, c.base+path, nil)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return newHTTPError(resp, ErrPayloadTooLarge)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return newHTTPError(resp, ErrInvalidResponse)
+	case out == nil || resp.StatusCode == http.StatusNoContent:
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := checkContentType(resp); err != nil {
+		return err
+	}
+	return c.decode(resp.Body, out)
+}
+
+func (c *Client) newRequestContext(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.requestHeader(ctx)
+	return req, nil
+}
+
+// requestHeader returns the headers of a request made with ctx.
+func (c *Client) requestHeader(ctx context.Context) http.Header {
+	h := make(http.Header)
+	accept := c.accept
+	if accept == "" {
+		accept = "application/json"
+	}
+	h.Set("Accept", accept)
+	h.Set("User-Agent", userAgent)
+	setHeaders(h, c.headers)
+	if rh, ok := ctx.Value(headersKey{}).(http.Header); ok {
+		setHeaders(h, rh)
+	}
+	if c.secret != "" && h.Get("Authorization") == "" {
+		h.Set("Authorization", c.secret)
+	}
+	return h
+}
+
+// setHeaders sets the headers in h on dst, replacing values dst has.
+func setHeaders(dst, h http.Header) {
+	for k, v := range h {
+		dst[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+}
+
+// decode decodes the JSON in r into v. A leading UTF-8 byte order mark is
+// skipped. Malformed JSON is reported as ErrDecode with the bytes around the
+// error; an empty body gives io.EOF.
+func (c *Client) decode(r io.Reader, v interface{}) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b = bytes.TrimPrefix(b, utf8BOM)
+	if len(bytes.TrimSpace(b)) == 0 {
+		return io.EOF
+	}
+	if c.lenient {
+		// Malformed JSON is left for the decoder below to report.
+		if n, err := lenientNumbers(b); err == nil {
+			b = n
+		}
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	if c.strict {
+		d.DisallowUnknownFields()
+	}
+	if err := d.Decode(v); err != nil {
+		offset := int64(len(b))
+		var serr *json.SyntaxError
+		var terr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &serr):
+			offset = serr.Offset
+		case errors.As(err, &terr):
+			offset = terr.Offset
+		}
+		return fmt.Errorf("%w: %s near %q", ErrDecode, err, snippet(b, offset))
+	}
+	return nil
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// snippet returns the bytes of b around offset.
+func snippet(b []byte, offset int64) []byte {
+	start, end := offset-32, offset+16
+	if start < 0 {
+		start = 0
+	}
+	if end > int64(len(b)) {
+		end = int64(len(b))
+	}
+	if start > end {
+		start = end
+	}
+	return b[start:end]
+}
+
+// checkContentType returns ErrNotJSON if resp does not carry JSON. The SkyDNS
+// server does not set a Content-Type, so the text/plain that Go sniffs for
+// JSON is accepted, as is none; this catches HTML error pages of proxies.
+func checkContentType(resp *http.Response) error {
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err == nil && (mt == "application/json" || mt == "text/plain" || strings.HasSuffix(mt, "+json")) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNotJSON, ct)
+}
+
+// newJSONRequest returns a request with v encoded as JSON in the body. If
+// request compression is enabled and the body is large, it is gzipped.
+func (c *Client) newJSONRequest(ctx context.Context, method, url string, v interface{}) (*http.Request, error) {
+	b := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(b).Encode(v); err != nil {
+		return nil, err
+	}
+	if !c.compress || b.Len() <= gzipThreshold {
+		req, err := c.newRequestContext(ctx, method, url, b)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
+	z := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(z)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := c.newRequestContext(ctx, method, url, z)
+	if err != nil {
+		return nil, err
 	}
-	return req, err
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	return req, nil
+}
+
+// newStreamingJSONRequest is like newJSONRequest, but encodes v while the
+// request body is read. The request has no GetBody, so it is never resent.
+func (c *Client) newStreamingJSONRequest(ctx context.Context, method, url string, v interface{}) (*http.Request, error) {
+	pr, pw := io.Pipe()
+	req, err := c.newRequestContext(ctx, method, url, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	go func() {
+		// A write the request does not read ends when its body is closed.
+		if !c.compress {
+			pw.CloseWithError(json.NewEncoder(pw).Encode(v))
+			return
+		}
+		w := gzip.NewWriter(pw)
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return req, nil
+}
+
+// qualify returns name, relative to the client's domain, as a name in the
+// domain.
+func (c *Client) qualify(name string) string {
+	if c.rawDomain {
+		return name + c.domain
+	}
+	return name + "." + c.domain
 }
 
 func (c *Client) newRequestDNS(qname string, qtype uint16) (*dns.Msg, error) {
@@ -282,13 +1459,19 @@ func (c *Client) newRequestDNS(qname string, qtype uint16) (*dns.Msg, error) {
 	if qname == "" {
 		m.SetQuestion(c.domain, qtype)
 	} else {
-		m.SetQuestion(qname+"."+c.domain, qtype)
+		m.SetQuestion(c.qualify(qname), qtype)
+	}
+	if c.ecs != nil {
+		m.SetEdns0(ednsUDPSize, false)
+		e := *c.ecs
+		o := m.IsEdns0()
+		o.Option = append(o.Option, &e)
 	}
 	return m, nil
 }
 
 func (c *Client) extractBaseFromLocation(location string) (string, error) {
-	u, err := url.ParseRequestURI(location) 
+	u, err := url.ParseRequestURI(location)
 	if err != nil {
 		return "", err
 	}
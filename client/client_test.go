@@ -0,0 +1,2718 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc, opts ...Option) (*Client, *httptest.Server) {
+	ts := httptest.NewServer(h)
+	c, err := NewClient(ts.URL, "", "skydns.local", "127.0.0.1:1", opts...)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return c, ts
+}
+
+func TestAddCompressed(t *testing.T) {
+	s := &msg.Service{
+		Name:        strings.Repeat("TestService", 200),
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "localhost",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         4,
+	}
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Content-Encoding not set to gzip: %q", req.Header.Get("Content-Encoding"))
+			http.Error(w, "not compressed", http.StatusBadRequest)
+			return
+		}
+		z, err := gzip.NewReader(req.Body)
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var serv msg.Service
+		if err := json.NewDecoder(z).Decode(&serv); err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if serv.Name != s.Name || serv.Port != s.Port {
+			t.Errorf("Decoded service %+v differs from sent service %+v", serv, *s)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}, WithRequestCompression(true))
+	defer ts.Close()
+
+	if err := c.Add("123", s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddSmallNotCompressed(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "" {
+			t.Errorf("Small body should not be compressed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}, WithRequestCompression(true))
+	defer ts.Close()
+
+	if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalkServices(t *testing.T) {
+	pages := map[string][]string{
+		"":  []string{"1", "2"},
+		"2": []string{"3", "4"},
+		"4": []string{"5"},
+	}
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("limit") != "2" {
+			t.Errorf("Expected limit of 2, got %q", req.URL.Query().Get("limit"))
+		}
+		cursor := req.URL.Query().Get("cursor")
+		var out []*msg.Service
+		for _, uuid := range pages[cursor] {
+			out = append(out, &msg.Service{UUID: uuid})
+		}
+		if len(out) == 2 {
+			w.Header().Set(nextCursorHeader, out[1].UUID)
+		}
+		json.NewEncoder(w).Encode(out)
+	})
+	defer ts.Close()
+
+	var seen []string
+	err := c.WalkServices(2, func(s *msg.Service) error {
+		seen = append(seen, s.UUID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(seen, ",") != "1,2,3,4,5" {
+		t.Fatalf("Walked services %v, expected 1 through 5", seen)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("[]"))
+	}, WithRateLimit(20, 1))
+	defer ts.Close()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := c.GetAllServices(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first request uses the burst, the others wait 50ms each.
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Fatalf("Expected 5 requests at 20 per second to take 200ms, took %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetAllServicesContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a canceled wait to fail, got %v", err)
+	}
+	if _, err := NewClient("http://127.0.0.1:8080", "", "skydns.local", "127.0.0.1:1", WithRateLimit(10, 0)); err != ErrInvalidRateLimit {
+		t.Fatalf("Expected ErrInvalidRateLimit, got %v", err)
+	}
+}
+
+func TestListNotFound(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		status int
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		code := status
+		mu.Unlock()
+		if code == http.StatusNotFound {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>502 Bad Gateway</body></html>"))
+	})
+	defer ts.Close()
+
+	lists := map[string]func() ([]*msg.Service, error){
+		"GetAllServices": c.GetAllServices,
+		"GetServicesAfter": func() ([]*msg.Service, error) {
+			services, next, err := c.GetServicesAfter("", 2)
+			if next != "" {
+				t.Errorf("Expected no next cursor, got %q", next)
+			}
+			return services, err
+		},
+		"GetServicesSorted": func() ([]*msg.Service, error) {
+			return c.GetServicesSorted("TTL", false, 0, 1)
+		},
+		"GetAllServicesIfChanged": func() ([]*msg.Service, error) {
+			services, _, changed, err := c.GetAllServicesIfChanged(`"1"`)
+			if err == nil && !changed {
+				t.Errorf("Expected a change")
+			}
+			return services, err
+		},
+		"GetServicesModifiedSince": func() ([]*msg.Service, error) {
+			return c.GetServicesModifiedSince(time.Now())
+		},
+		"GetServicesProjected": func() ([]*msg.Service, error) {
+			return c.GetServicesProjected([]string{"Host"})
+		},
+		"StreamAllServices": func() ([]*msg.Service, error) {
+			services := make([]*msg.Service, 0)
+			err := c.StreamAllServices(context.Background(), func(s *msg.Service) error {
+				services = append(services, s)
+				return nil
+			})
+			return services, err
+		},
+	}
+	for name, list := range lists {
+		mu.Lock()
+		status = http.StatusNotFound
+		mu.Unlock()
+		if services, err := list(); err != nil || services == nil || len(services) != 0 {
+			t.Errorf("%s: Expected no services for a 404, got %v, %v", name, services, err)
+		}
+		mu.Lock()
+		status = http.StatusOK
+		mu.Unlock()
+		if _, err := list(); !errors.Is(err, ErrNotJSON) {
+			t.Errorf("%s: Expected ErrNotJSON for an HTML page, got %v", name, err)
+		}
+	}
+}
+
+func TestStreamAllServices(t *testing.T) {
+	const full = `[{"UUID":"1","Host":"a","Port":1},{"UUID":"2","Host":"b","Port":2}]`
+	for _, tc := range []struct {
+		body      string
+		truncated bool
+	}{
+		{full, false},
+		{"null", false},
+		{full[:len(full)-1], true},
+		{full[:len(full)-12], true},
+		{full[:36], true},
+	} {
+		c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(tc.body))
+		})
+		var uuids []string
+		err := c.StreamAllServices(context.Background(), func(s *msg.Service) error {
+			uuids = append(uuids, s.UUID)
+			return nil
+		})
+		ts.Close()
+
+		if !tc.truncated {
+			if err != nil {
+				t.Errorf("%s: %v", tc.body, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrDecode) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: Expected ErrDecode and io.ErrUnexpectedEOF, got %v", tc.body, err)
+		}
+		if len(uuids) < 1 || uuids[0] != "1" {
+			t.Errorf("%s: Expected the services before the truncation, got %v", tc.body, uuids)
+		}
+	}
+
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(full[:34] + "x]"))
+	})
+	defer ts.Close()
+	err := c.StreamAllServices(context.Background(), func(s *msg.Service) error { return nil })
+	if !errors.Is(err, ErrDecode) || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrDecode for malformed JSON, got %v", err)
+	}
+}
+
+func TestAddConflictCheck(t *testing.T) {
+	existing := msg.Service{UUID: "123", Name: "TestService", Host: "localhost", Port: 9000, TTL: 3}
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "PUT":
+			http.Error(w, "Service already exists in registry", http.StatusConflict)
+		case "GET":
+			json.NewEncoder(w).Encode(existing)
+		}
+	}, WithConflictCheck(true))
+	defer ts.Close()
+
+	if err := c.Add("123", &msg.Service{Name: "TestService", Host: "localhost", Port: 9000, TTL: 10}); err != nil {
+		t.Fatalf("Identical service should not conflict: %s", err)
+	}
+	if err := c.Add("123", &msg.Service{Name: "TestService", Host: "localhost", Port: 9001, TTL: 10}); err != ErrConflictingUUID {
+		t.Fatalf("Expected ErrConflictingUUID, got %v", err)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		keys = append(keys, req.Header.Get("Idempotency-Key"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}, WithIdempotencyKeys(true))
+	defer ts.Close()
+
+	s := &msg.Service{Host: "localhost", Port: 9000}
+	ctx := WithIdempotencyToken(context.Background(), "run-1")
+	for i := 0; i < 2; i++ {
+		if err := c.AddContext(ctx, "123", s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AddContext(WithIdempotencyToken(context.Background(), "run-2"), "123", s); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("123", s); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("123", s); err != nil {
+		t.Fatal(err)
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[2] == keys[0] || keys[3] == "" || keys[3] != keys[4] {
+		t.Fatalf("Expected keys stable per token and service, got %q", keys)
+	}
+}
+
+func TestAddAndWait(t *testing.T) {
+	var gets int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "PUT":
+			if req.URL.Path == "/skydns/services/taken" {
+				http.Error(w, "Service already exists in registry", http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			if atomic.AddInt32(&gets, 1) < 3 {
+				http.Error(w, "Service does not exist in registry", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(&msg.Service{UUID: "123", Host: "localhost", Port: 9000})
+		}
+	})
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	s := &msg.Service{Host: "localhost", Port: 9000}
+	if err := c.AddAndWait(ctx, "123", s, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 3 {
+		t.Fatalf("Expected 3 polls, got %d", n)
+	}
+	if err := c.AddAndWait(ctx, "taken", s, 10*time.Millisecond); !errors.Is(err, ErrConflictingUUID) {
+		t.Fatalf("Expected ErrConflictingUUID, got %v", err)
+	}
+	if err := c.AddAndWait(ctx, "taken", s, 0); err != ErrInvalidInterval {
+		t.Fatalf("Expected ErrInvalidInterval before the Add, got %v", err)
+	}
+}
+
+func TestForceOnConflict(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		existing = &msg.Service{UUID: "123", Host: "localhost", Port: 9000}
+		deletes  int
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.Method {
+		case "PUT":
+			if existing != nil {
+				http.Error(w, "Service already exists in registry", http.StatusConflict)
+				return
+			}
+			existing = new(msg.Service)
+			json.NewDecoder(req.Body).Decode(existing)
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			json.NewEncoder(w).Encode(existing)
+		case "DELETE":
+			deletes++
+			existing = nil
+		}
+	}, WithForceOnConflict(true))
+	defer ts.Close()
+
+	overwritten, err := c.AddWithOverwrite("123", &msg.Service{Host: "localhost", Port: 9000})
+	if err != nil || overwritten || deletes != 0 {
+		t.Fatalf("Expected an identical service to be left alone, got %t, %v and %d deletes", overwritten, err, deletes)
+	}
+	if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9001}); err != nil {
+		t.Fatal(err)
+	}
+	if deletes != 1 || existing.Port != 9001 {
+		t.Fatalf("Expected the service to be replaced, got %d deletes and port %d", deletes, existing.Port)
+	}
+
+	mu.Lock()
+	existing.TTL = 12
+	mu.Unlock()
+	overwritten, err = c.AddWithOverwrite("123", &msg.Service{Host: "localhost", Port: 9001, TTL: 30})
+	if err != nil || overwritten || deletes != 1 {
+		t.Fatalf("Expected a service differing in its remaining TTL to be left alone, got %t, %v and %d deletes", overwritten, err, deletes)
+	}
+	overwritten, err = c.AddWithOverwrite("123", &msg.Service{Host: "localhost", Port: 9001, Metadata: map[string]string{"team": "a"}})
+	if err != nil || !overwritten || deletes != 2 || existing.Metadata["team"] != "a" {
+		t.Fatalf("Expected a Metadata change to replace the service, got %t, %v and %d deletes", overwritten, err, deletes)
+	}
+	overwritten, err = c.AddWithOverwrite("123", &msg.Service{Host: "localhost", Port: 9001, Metadata: map[string]string{"team": "a"}, NoExpire: true})
+	if err != nil || !overwritten || deletes != 3 || !existing.NoExpire {
+		t.Fatalf("Expected a NoExpire change to replace the service, got %t, %v and %d deletes", overwritten, err, deletes)
+	}
+}
+
+func TestFollowLeader(t *testing.T) {
+	var puts int
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var serv msg.Service
+		if err := json.NewDecoder(req.Body).Decode(&serv); err != nil || serv.Port != 9000 {
+			t.Errorf("Leader did not receive the service: %v", err)
+		}
+		puts++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer leader.Close()
+
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, leader.URL+req.URL.Path, http.StatusMovedPermanently)
+	}, WithFollowLeader(true))
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if puts != 2 {
+		t.Fatalf("Expected 2 PUTs on the leader, got %d", puts)
+	}
+	if c.leader.base != leader.URL {
+		t.Fatalf("Expected leader %s to be remembered, got %s", leader.URL, c.leader.base)
+	}
+}
+
+func TestAddTemporaryRedirect(t *testing.T) {
+	var redirected bool
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/skydns/services/123" {
+			http.Redirect(w, req, "/moved/skydns/services/123", http.StatusTemporaryRedirect)
+			return
+		}
+		redirected = true
+		if req.Method != "PUT" {
+			t.Errorf("Expected a PUT after the redirect, got %s", req.Method)
+		}
+		if req.Header.Get("Authorization") != "secret" {
+			t.Errorf("Authorization header lost in the redirect")
+		}
+		var serv msg.Service
+		if err := json.NewDecoder(req.Body).Decode(&serv); err != nil || serv.Host != "localhost" || serv.Port != 9000 {
+			t.Errorf("Body not replayed in the redirect: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer ts.Close()
+	c.secret = "secret"
+
+	if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	if !redirected {
+		t.Fatal("Redirect not followed")
+	}
+}
+
+func TestRedirectRequestAuthorization(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/skydns/services/123" {
+			http.Redirect(w, req, "/moved/skydns/services/123", http.StatusTemporaryRedirect)
+			return
+		}
+		if auth := req.Header.Values("Authorization"); len(auth) != 1 || auth[0] != "per-call" {
+			t.Errorf("Expected the per-call Authorization after the redirect, got %q", auth)
+		}
+		json.NewEncoder(w).Encode(&msg.Service{UUID: "123", Host: "localhost", Port: 9000})
+	})
+	defer ts.Close()
+	c.secret = "client-secret"
+
+	ctx := WithRequestHeaders(context.Background(), http.Header{"Authorization": {"per-call"}})
+	if _, err := c.GetContext(ctx, "123"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddCrossHostRedirect(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("Secret sent to another host")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer other.Close()
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, other.URL+req.URL.Path, http.StatusTemporaryRedirect)
+	})
+	defer ts.Close()
+	c.secret = "secret"
+
+	if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9000}); !errors.Is(err, ErrCrossHostRedirect) {
+		t.Fatalf("Expected ErrCrossHostRedirect, got %v", err)
+	}
+	c.crossHostRedirects = true
+	if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddLeaderRedirect(t *testing.T) {
+	var puts int32
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&puts, 1)
+		if req.Header.Get("Authorization") != "secret" {
+			t.Errorf("Expected the secret on the leader, got %q", req.Header.Get("Authorization"))
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer leader.Close()
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, leader.URL+req.URL.Path, http.StatusMovedPermanently)
+	})
+	defer ts.Close()
+	c.secret = "secret"
+
+	if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&puts); n != 1 || c.base != leader.URL {
+		t.Fatalf("Expected the Add to move to the leader, got %d PUTs and base %s", n, c.base)
+	}
+}
+
+func TestGetAllServicesIfChanged(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"1"`)
+		json.NewEncoder(w).Encode([]*msg.Service{&msg.Service{UUID: "123"}})
+	})
+	defer ts.Close()
+
+	services, etag, changed, err := c.GetAllServicesIfChanged("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || etag != `"1"` || len(services) != 1 {
+		t.Fatalf("Expected one changed service with an ETag, got %d %q %t", len(services), etag, changed)
+	}
+	services, etag, changed, err = c.GetAllServicesIfChanged(etag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || etag != `"1"` || services != nil {
+		t.Fatalf("Expected no change, got %d %q %t", len(services), etag, changed)
+	}
+}
+
+func TestServiceAddr(t *testing.T) {
+	tests := []struct {
+		host string
+		port uint16
+		addr string
+		err  error
+	}{
+		{"10.0.0.1", 80, "10.0.0.1:80", nil},
+		{"::1", 53, "[::1]:53", nil},
+		{"[2001:db8::1]", 8080, "[2001:db8::1]:8080", nil},
+		{"web1.site.com.", 9000, "web1.site.com:9000", nil},
+		{"web1.site.com", 0, "", ErrNoPort},
+		{"", 9000, "", ErrNoHost},
+	}
+	for _, tc := range tests {
+		addr, err := ServiceAddr(&msg.Service{Host: tc.host, Port: tc.port})
+		if addr != tc.addr || err != tc.err {
+			t.Errorf("ServiceAddr(%q, %d) = %q, %v, expected %q, %v", tc.host, tc.port, addr, err, tc.addr, tc.err)
+		}
+	}
+}
+
+func TestHeartbeatSetTTL(t *testing.T) {
+	ttls := make(chan uint32, 10)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		var serv msg.Service
+		json.NewDecoder(req.Body).Decode(&serv)
+		ttls <- serv.TTL
+	})
+	defer ts.Close()
+
+	if _, err := c.Heartbeat("123", 10, 10*time.Second); err != ErrHeartbeatTooSlow {
+		t.Fatalf("Expected ErrHeartbeatTooSlow, got %v", err)
+	}
+	h, err := c.Heartbeat("123", 120, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	if err := h.SetTTL(0); err != ErrInvalidTTL {
+		t.Fatalf("Expected ErrInvalidTTL, got %v", err)
+	}
+	if err := h.SetTTL(60); err != ErrHeartbeatTooSlow {
+		t.Fatalf("Expected ErrHeartbeatTooSlow for a TTL the interval exceeds, got %v", err)
+	}
+	if err := h.SetTTL(90); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ttl := <-ttls:
+		if ttl != 90 {
+			t.Fatalf("Expected TTL 90, got %d", ttl)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No refresh after SetTTL")
+	}
+
+	h.SetInterval(10 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		select {
+		case ttl := <-ttls:
+			if ttl != 90 {
+				t.Fatalf("Expected TTL 90, got %d", ttl)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("No refresh after SetInterval")
+		}
+	}
+}
+
+func TestGetStrictDecoding(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"UUID":"123","Host":"localhost","Port":9000,"Weight":10}`))
+	})
+	defer ts.Close()
+
+	if _, err := c.Get("123"); err != nil {
+		t.Fatalf("Lenient decoding failed: %s", err)
+	}
+	c.strict = true
+	if _, err := c.Get("123"); err == nil {
+		t.Fatal("Strict decoding accepted an unknown field")
+	}
+}
+
+func TestWatchTimeout(t *testing.T) {
+	var polls int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&polls, 1) == 1 {
+			// Hang the first poll.
+			select {
+			case <-req.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		json.NewEncoder(w).Encode([]*msg.Service{&msg.Service{UUID: "123", Host: "localhost", Port: 9000}})
+	})
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := c.Watch(ctx, 20*time.Millisecond, 50*time.Millisecond)
+
+	ev := <-events
+	if ev.Err == nil {
+		t.Fatal("Expected the hung poll to be reported as an error")
+	}
+	select {
+	case ev = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("Watch stalled after a hung poll")
+	}
+	if ev.Err != nil || len(ev.Added) != 1 {
+		t.Fatalf("Expected one added service, got %+v", ev)
+	}
+}
+
+func TestWatchInvalidInterval(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Unexpected poll %s", req.URL)
+	})
+	defer ts.Close()
+
+	events := c.Watch(context.Background(), 0, time.Second)
+	if ev := <-events; ev.Err != ErrInvalidInterval {
+		t.Fatalf("Expected ErrInvalidInterval, got %+v", ev)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("Expected the channel to be closed")
+	}
+}
+
+func TestUpdateStatus(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		if _, ok := body["TTL"]; !ok {
+			t.Errorf("TTL missing from the update: %v", body)
+		}
+		switch req.URL.Path {
+		case "/skydns/services/123":
+		case "/skydns/services/404":
+			http.Error(w, "Service does not exist in registry", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		}
+	})
+	defer ts.Close()
+
+	if err := c.Update("123", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Update("404", 10); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("Expected ErrServiceNotFound, got %v", err)
+	}
+	if err := c.Update("500", 10); !errors.Is(err, ErrInvalidResponse) {
+		t.Fatalf("Expected ErrInvalidResponse, got %v", err)
+	}
+}
+
+func TestDiffServices(t *testing.T) {
+	current := map[string]*msg.Service{
+		"1": &msg.Service{Host: "10.0.0.1", Port: 80, TTL: 10},
+		"2": &msg.Service{Host: "10.0.0.2", Port: 80, TTL: 10},
+		"3": &msg.Service{Host: "10.0.0.3", Port: 80, TTL: 10},
+	}
+	desired := map[string]*msg.Service{
+		"1": &msg.Service{Host: "10.0.0.1", Port: 80, TTL: 10},
+		"2": &msg.Service{Host: "10.0.0.2", Port: 8080, TTL: 10},
+		"4": &msg.Service{Host: "10.0.0.4", Port: 80, TTL: 10},
+	}
+	toAdd, toUpdate, toDelete := DiffServices(current, desired)
+	if len(toAdd) != 1 || toAdd["4"] == nil {
+		t.Errorf("Expected 4 to be added, got %v", toAdd)
+	}
+	if len(toUpdate) != 1 || toUpdate["2"] == nil {
+		t.Errorf("Expected 2 to be updated, got %v", toUpdate)
+	}
+	if len(toDelete) != 1 || toDelete[0] != "3" {
+		t.Errorf("Expected 3 to be deleted, got %v", toDelete)
+	}
+}
+
+func TestNameCountDiff(t *testing.T) {
+	old := NameCount{"east": 2, "west": 1, "north": 4}
+	cur := NameCount{"east": 3, "north": 4, "south": 1, "central": 2}
+	added, removed, changed := cur.Diff(old)
+	if strings.Join(added, ",") != "central,south" || strings.Join(removed, ",") != "west" {
+		t.Fatalf("Expected central and south added and west removed, got %v and %v", added, removed)
+	}
+	if len(changed) != 1 || changed["east"] != [2]int{2, 3} {
+		t.Fatalf("Expected east to change from 2 to 3, got %v", changed)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			t.Errorf("Expected HTTP/2, got %s", req.Proto)
+		}
+		if req.Header.Get("Authorization") != "secret" {
+			t.Errorf("Authorization header missing")
+		}
+		json.NewEncoder(w).Encode([]*msg.Service{&msg.Service{UUID: "123"}})
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL, "secret", "skydns.local", "127.0.0.1:1", WithHTTPClient(ts.Client()), WithHTTP2(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := c.GetAllServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("Expected 1 service, got %d", len(services))
+	}
+}
+
+func TestAddWithResponse(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Request-Id", "42")
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer ts.Close()
+
+	h, err := c.AddWithResponse("123", &msg.Service{Host: "localhost", Port: 9000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("X-Request-Id") != "42" {
+		t.Fatalf("Expected the X-Request-Id header, got %v", h)
+	}
+}
+
+func TestUpdateEffective(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/skydns/services/clamped":
+			w.Write([]byte(`{"TTL":30}`))
+		case "/skydns/services/plain":
+			w.Write([]byte("OK\n"))
+		}
+	})
+	defer ts.Close()
+
+	if err := c.Update("plain", 10); err != nil {
+		t.Fatalf("Expected a plain text success to succeed, got %v", err)
+	}
+	if ttl, err := c.UpdateEffective("plain", 10); err != nil || ttl != 10 {
+		t.Fatalf("Expected the requested TTL of 10 for a plain text reply, got %d, %v", ttl, err)
+	}
+
+	if ttl, err := c.UpdateEffective("clamped", 10); err != nil || ttl != 30 {
+		t.Fatalf("Expected the clamped TTL of 30, got %d, %v", ttl, err)
+	}
+	if ttl, err := c.UpdateEffective("123", 10); err != nil || ttl != 10 {
+		t.Fatalf("Expected the requested TTL of 10, got %d, %v", ttl, err)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	})
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.GetContext(ctx, "123"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the call to abort after 50ms, took %v", d)
+	}
+
+	start = time.Now()
+	ctx = WithRequestTimeout(context.Background(), 50*time.Millisecond)
+	if err := c.DeleteContext(ctx, "123"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the call to abort after 50ms, took %v", d)
+	}
+}
+
+func TestAddIfNotExists(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/skydns/services/new":
+			w.WriteHeader(http.StatusCreated)
+		case "/skydns/services/taken":
+			http.Error(w, "Service already exists in registry", http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}, WithConflictCheck(true))
+	defer ts.Close()
+
+	s := &msg.Service{Name: "TestService", Host: "localhost", Port: 9000, TTL: 10}
+	if created, err := c.AddIfNotExists("new", s); !created || err != nil {
+		t.Fatalf("Expected the service to be created, got %v, %v", created, err)
+	}
+	if created, err := c.AddIfNotExists("taken", s); created || err != nil {
+		t.Fatalf("Expected the existing service to be kept, got %v, %v", created, err)
+	}
+	if _, err := c.AddIfNotExists("broken", s); !errors.Is(err, ErrInvalidResponse) {
+		t.Fatalf("Expected ErrInvalidResponse, got %v", err)
+	}
+}
+
+func newTestProxy(t *testing.T, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Host != "skydns.example:8080" {
+			t.Errorf("Expected a proxied request for skydns.example:8080, got %s", req.URL)
+		}
+		atomic.AddInt32(hits, 1)
+		json.NewEncoder(w).Encode([]*msg.Service{})
+	}))
+}
+
+func TestWithProxy(t *testing.T) {
+	var hits int32
+	proxy := newTestProxy(t, &hits)
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	c, err := NewClient("http://skydns.example:8080", "", "skydns.local", "127.0.0.1:1", WithProxy(http.ProxyURL(u)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetAllServices(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("Expected 1 request through the proxy, got %d", hits)
+	}
+}
+
+type countingTransport struct {
+	n  int32
+	rt http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.n, 1)
+	return t.rt.RoundTrip(req)
+}
+
+func TestWithTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode([]*msg.Service{})
+	}))
+	defer ts.Close()
+
+	shared := &countingTransport{rt: http.DefaultTransport}
+	for i := 0; i < 2; i++ {
+		c, err := NewClient(ts.URL, "", "skydns.local", "127.0.0.1:1", WithTransport(shared))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Transport() != shared {
+			t.Fatalf("Expected the shared transport, got %v", c.Transport())
+		}
+		if _, err := c.GetAllServices(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&shared.n); n != 2 {
+		t.Fatalf("Expected 2 requests through the shared transport, got %d", n)
+	}
+
+	c, err := NewClient(ts.URL, "", "skydns.local", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Transport() != http.DefaultTransport {
+		t.Fatalf("Expected http.DefaultTransport, got %v", c.Transport())
+	}
+	if _, err := NewClient(ts.URL, "", "skydns.local", "127.0.0.1:1", WithTransport(nil)); !errors.Is(err, ErrInvalidTransport) {
+		t.Fatalf("Expected ErrInvalidTransport, got %v", err)
+	}
+}
+
+// TestProxyEnvironment runs itself in a new process, as the proxy
+// environment variables are only read once per process.
+func TestProxyEnvironment(t *testing.T) {
+	if os.Getenv("SKYDNS_TEST_PROXY_CHILD") != "" {
+		c, err := NewClient("http://skydns.example:8080", "", "skydns.local", "127.0.0.1:1", WithDialTimeout(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.GetAllServices(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	var hits int32
+	proxy := newTestProxy(t, &hits)
+	defer proxy.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestProxyEnvironment$")
+	cmd.Env = append(os.Environ(), "SKYDNS_TEST_PROXY_CHILD=1", "HTTP_PROXY="+proxy.URL, "NO_PROXY=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Request with HTTP_PROXY set failed: %v\n%s", err, out)
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("Expected 1 request through the proxy, got %d", hits)
+	}
+}
+
+func TestExportZone(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode([]*msg.Service{
+			nil,
+			&msg.Service{UUID: "2", Name: "web", Version: "1.0", Region: "east", Environment: "prod", Host: "web.example.com", Port: 80, TTL: 30},
+			&msg.Service{UUID: "1", Name: "db", Version: "2", Region: "east", Environment: "prod", Host: "10.0.0.1", Port: 5432, TTL: 60},
+		})
+	})
+	defer ts.Close()
+
+	var b bytes.Buffer
+	if err := c.ExportZone(&b); err != nil {
+		t.Fatal(err)
+	}
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(&b, "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 3 {
+		t.Fatalf("Expected 3 records, got %v", rrs)
+	}
+	srv, ok := rrs[0].(*dns.SRV)
+	if !ok || srv.Hdr.Name != "1.10-0-0-1.east.2.db.prod.skydns.local." || srv.Target != "1.skydns.local." || srv.Port != 5432 {
+		t.Fatalf("Unexpected SRV record %v", rrs[0])
+	}
+	if a, ok := rrs[1].(*dns.A); !ok || a.Hdr.Name != "1.skydns.local." || a.A.String() != "10.0.0.1" {
+		t.Fatalf("Unexpected A record %v", rrs[1])
+	}
+	if srv, ok := rrs[2].(*dns.SRV); !ok || srv.Target != "web.example.com." || srv.Hdr.Ttl != 30 {
+		t.Fatalf("Unexpected SRV record %v", rrs[2])
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		added = make(map[string]uint16)
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			json.NewEncoder(w).Encode([]*msg.Service{
+				&msg.Service{UUID: "b", Host: "10.0.0.2", Port: 80},
+				&msg.Service{UUID: "a", Host: "10.0.0.1", Port: 80},
+			})
+		case "PUT":
+			if strings.HasSuffix(req.URL.Path, "/bad") {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			var serv msg.Service
+			json.NewDecoder(req.Body).Decode(&serv)
+			mu.Lock()
+			added[serv.UUID] = serv.Port
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	if err := c.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var exported []*msg.Service
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil || len(exported) != 2 || exported[0].UUID != "b" {
+		t.Fatalf("Expected the 2 services in the server's order, got %s, %v", buf.String(), err)
+	}
+
+	if errs := c.Import(&buf, 2); len(errs) != 0 {
+		t.Fatalf("Expected no import errors, got %v", errs)
+	}
+	if added["a"] != 80 || added["b"] != 80 {
+		t.Fatalf("Expected both services to be added, got %v", added)
+	}
+
+	errs := c.Import(strings.NewReader(`[{"UUID":"bad","Port":80},{"Port":80}]`), 1)
+	if !errors.Is(errs["bad"], ErrInvalidResponse) || errs[""] != ErrNoUUID {
+		t.Fatalf("Expected per-uuid errors, got %v", errs)
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		http.NotFound(w, req)
+	})
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	if err := c.Export(&buf); err != nil || buf.String() != "[]\n" {
+		t.Fatalf("Expected an empty array, got %q, %v", buf.String(), err)
+	}
+}
+
+func TestWeightedEndpoints(t *testing.T) {
+	var hits [2]int32
+	newServer := func(i int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+			json.NewEncoder(w).Encode([]*msg.Service{})
+		}))
+	}
+	a, b := newServer(0), newServer(1)
+	defer a.Close()
+
+	c, err := NewClient(a.URL, "", "skydns.local", "127.0.0.1:1", WithEndpoints([]WeightedEndpoint{
+		{Base: a.URL, Weight: 3},
+		{Base: b.URL, Weight: 1},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if _, err := c.GetAllServices(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits[0] != 6 || hits[1] != 2 {
+		t.Fatalf("Expected 6 and 2 requests, got %d and %d", hits[0], hits[1])
+	}
+
+	b.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := c.GetAllServices(); err != nil {
+			t.Fatalf("Expected the down endpoint to be skipped, got %v", err)
+		}
+	}
+	if hits[0] != 10 || hits[1] != 2 {
+		t.Fatalf("Expected 10 and 2 requests, got %d and %d", hits[0], hits[1])
+	}
+}
+
+func TestDeleteNotFound(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/skydns/services/gone" {
+			http.Error(w, "Service does not exist", http.StatusNotFound)
+		}
+	})
+	defer ts.Close()
+
+	if err := c.Delete("123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("gone"); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("Expected ErrServiceNotFound, got %v", err)
+	}
+	c, err := NewClient(ts.URL, "", "skydns.local", "127.0.0.1:1", WithDeleteIdempotent(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("gone"); err != nil {
+		t.Fatalf("Expected an idempotent delete to succeed, got %v", err)
+	}
+}
+
+func TestDo(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "secret" {
+			t.Errorf("Authorization header not set")
+		}
+		if ua := req.Header.Get("User-Agent"); ua != userAgent {
+			t.Errorf("Expected the User-Agent %q, got %q", userAgent, ua)
+		}
+		switch req.URL.Path {
+		case "/skydns/echo":
+			if req.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("Expected a JSON body, got %q", req.Header.Get("Content-Type"))
+			}
+			io.Copy(w, req.Body)
+		case "/skydns/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	defer ts.Close()
+	c.secret = "secret"
+
+	var out map[string]int
+	if err := c.Do(context.Background(), "POST", "/skydns/echo", map[string]int{"a": 1}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["a"] != 1 {
+		t.Fatalf("Expected the echoed body, got %v", out)
+	}
+	if err := c.Do(context.Background(), "GET", "/skydns/empty", nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	var herr *HTTPError
+	if err := c.Do(context.Background(), "GET", "/skydns/unknown", nil, nil); !errors.As(err, &herr) || herr.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected an HTTPError with status 404, got %v", err)
+	}
+	if err := c.Do(context.Background(), "GET", "skydns/echo", nil, nil); err != ErrInvalidPath {
+		t.Fatalf("Expected ErrInvalidPath, got %v", err)
+	}
+}
+
+func TestHTTPErrorRequest(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Service does not exist", http.StatusNotFound)
+	})
+	defer ts.Close()
+
+	_, err := c.Get("404")
+	var herr *HTTPError
+	if !errors.As(err, &herr) || !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("Expected an HTTPError wrapping ErrServiceNotFound, got %v", err)
+	}
+	if herr.Method != "GET" || herr.URL != ts.URL+"/skydns/services/404" {
+		t.Fatalf("Expected GET %s/skydns/services/404, got %s %s", ts.URL, herr.Method, herr.URL)
+	}
+	if !strings.Contains(err.Error(), "GET "+herr.URL) {
+		t.Fatalf("Expected the method and URL in %q", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Header.Get("Authorization") {
+		case "secret":
+			w.Write([]byte(`{}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	for secret, want := range map[string]error{"secret": nil, "wrong": ErrUnauthorized, "broken": ErrServerError} {
+		c, err := NewClient(ts.URL, secret, "skydns.local", "127.0.0.1:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Verify(context.Background()); !errors.Is(err, want) {
+			t.Errorf("Expected %v for secret %q, got %v", want, secret, err)
+		}
+	}
+
+	ts.Close()
+	c, err := NewClient(ts.URL, "secret", "skydns.local", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(context.Background()); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("Expected ErrUnreachable, got %v", err)
+	}
+}
+
+func TestServiceEqual(t *testing.T) {
+	a := &msg.Service{UUID: "1", Name: "web", Host: "10.0.0.1", Port: 80, TTL: 10, Metadata: map[string]string{"team": "a", "tier": "1"}}
+	b := &msg.Service{UUID: "2", Name: "web", Host: "10.0.0.1", Port: 80, TTL: 10, Metadata: map[string]string{"tier": "1", "team": "a"},
+		Expires: time.Now()}
+	if !ServiceEqual(a, b) || ServiceHash(a) != ServiceHash(b) {
+		t.Fatal("Expected services differing in UUID and expiry to be equal")
+	}
+	if !ServiceEqual(&msg.Service{}, &msg.Service{Metadata: map[string]string{}}) ||
+		ServiceHash(&msg.Service{}) != ServiceHash(&msg.Service{Metadata: map[string]string{}}) {
+		t.Fatal("Expected nil and empty metadata to be equal")
+	}
+	b.Metadata["team"] = "b"
+	if ServiceEqual(a, b) || ServiceHash(a) == ServiceHash(b) {
+		t.Fatal("Expected services with different metadata to differ")
+	}
+	b.Metadata["team"] = "a"
+	b.TTL = 20
+	if ServiceEqual(a, b) || ServiceHash(a) == ServiceHash(b) {
+		t.Fatal("Expected services with different TTLs to differ")
+	}
+}
+
+func TestServiceSRVRoundTrip(t *testing.T) {
+	for _, s := range []*msg.Service{
+		&msg.Service{UUID: "1", Host: "web.example.com", Port: 80, TTL: 30},
+		&msg.Service{UUID: "2", Host: "web.example.com.", Port: 443, TTL: 10},
+	} {
+		srv := ServiceToSRV("web.prod.skydns.local", "skydns.local", s)
+		if srv.Hdr.Name != "web.prod.skydns.local." || srv.Priority != 10 || srv.Weight != 100 || srv.Target != "web.example.com." {
+			t.Errorf("Unexpected SRV record %v for %v", srv, s)
+		}
+		if b := SRVToService(srv); b.Host != "web.example.com" || b.Port != s.Port || b.TTL != s.TTL {
+			t.Errorf("Expected %v back, got %v", s, b)
+		}
+	}
+	srv := ServiceToSRV("db.prod.skydns.local.", "skydns.local", &msg.Service{UUID: "3", Host: "10.0.0.1", Port: 5432})
+	if srv.Target != "3.skydns.local." {
+		t.Fatalf("Expected the UUID target for an IP address, got %q", srv.Target)
+	}
+}
+
+func TestValidateServices(t *testing.T) {
+	errs := ValidateServices(map[string]*msg.Service{
+		"ok":     &msg.Service{Host: "10.0.0.1", Port: 80},
+		"noport": &msg.Service{Host: "10.0.0.1"},
+		"nohost": &msg.Service{Port: 80},
+		"nil":    nil,
+		"":       &msg.Service{Host: "10.0.0.1", Port: 80},
+	})
+	if len(errs) != 4 || errs["noport"] != ErrNoPort || errs["nohost"] != ErrNoHost ||
+		errs["nil"] != ErrNoHost || errs[""] != ErrNoUUID {
+		t.Fatalf("Expected errors for all but the valid service, got %v", errs)
+	}
+	if errs := ValidateServices(nil); errs == nil || len(errs) != 0 {
+		t.Fatalf("Expected an empty map, got %v", errs)
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	c, err := NewClient("http://127.0.0.1:8080/%zz", "secret", "skydns.local", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("123"); err == nil {
+		t.Fatal("Expected an error for an invalid URL")
+	}
+}
+
+func TestValidateCallback(t *testing.T) {
+	for _, cb := range []*msg.Callback{
+		&msg.Callback{Name: "web", Reply: "localhost", Port: 8080},
+		&msg.Callback{Name: "web", Reply: "10.0.0.1", Port: 8080},
+		&msg.Callback{Name: "web", Reply: "[2001:db8::1]", Port: 8080},
+	} {
+		if err := ValidateCallback(cb); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", cb, err)
+		}
+	}
+	for _, cb := range []*msg.Callback{
+		nil,
+		&msg.Callback{Reply: "localhost", Port: 8080},
+		&msg.Callback{Name: "web", Reply: "localhost"},
+		&msg.Callback{Name: "web", Port: 8080},
+		&msg.Callback{Name: "web", Reply: "http://localhost", Port: 8080},
+		&msg.Callback{Name: "web", Reply: "localhost:9000", Port: 8080},
+		&msg.Callback{Name: "web", Reply: "localhost/hook", Port: 8080},
+		&msg.Callback{Name: "web", Reply: "2001:db8::1", Port: 8080},
+	} {
+		if err := ValidateCallback(cb); !errors.Is(err, ErrInvalidCallback) {
+			t.Errorf("Expected ErrInvalidCallback for %+v, got %v", cb, err)
+		}
+	}
+
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Invalid callback sent to the server")
+	})
+	defer ts.Close()
+	if err := c.AddCallback("123", &msg.Callback{Name: "web"}); !errors.Is(err, ErrInvalidCallback) {
+		t.Fatalf("Expected ErrInvalidCallback, got %v", err)
+	}
+}
+
+func TestCallbackCheck(t *testing.T) {
+	var puts int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&puts, 1)
+		w.WriteHeader(http.StatusCreated)
+	}, WithCallbackCheck(true))
+	defer ts.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := &msg.Callback{Name: "web", Reply: "127.0.0.1", Port: uint16(l.Addr().(*net.TCPAddr).Port)}
+	if err := c.AddCallback("123", cb); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if err := c.AddCallback("123", cb); !errors.Is(err, ErrInvalidCallback) {
+		t.Fatalf("Expected ErrInvalidCallback for an unreachable reply address, got %v", err)
+	}
+	if n := atomic.LoadInt32(&puts); n != 1 {
+		t.Fatalf("Expected 1 PUT, got %d", n)
+	}
+}
+
+func TestAddCallback(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Correlation-Id") != "42" {
+			t.Errorf("Expected the X-Correlation-Id header, got %v", req.Header)
+		}
+		if req.URL.Path == "/skydns/callbacks/broken" {
+			http.Error(w, "raft failure", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer ts.Close()
+
+	cb := &msg.Callback{Name: "web", Reply: "10.0.0.1", Port: 8080}
+	if err := c.AddCallback("123", cb, WithHeader("X-Correlation-Id", "42")); err != nil {
+		t.Fatal(err)
+	}
+	err := c.AddCallback("broken", cb, WithHeader("X-Correlation-Id", "42"))
+	var herr *HTTPError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusServiceUnavailable || herr.Body != "raft failure" {
+		t.Fatalf("Expected an HTTPError with status 503, got %v", err)
+	}
+	if !errors.Is(err, ErrInvalidResponse) {
+		t.Fatalf("Expected the HTTPError to wrap ErrInvalidResponse, got %v", err)
+	}
+}
+
+func TestConnectionResetRetry(t *testing.T) {
+	var puts int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&puts, 1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		var serv msg.Service
+		if err := json.NewDecoder(req.Body).Decode(&serv); err != nil || serv.Port != 9000 {
+			t.Errorf("Body not replayed on the retry: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer ts.Close()
+
+	if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&puts); n != 2 {
+		t.Fatalf("Expected 2 PUTs, got %d", n)
+	}
+}
+
+func TestStreamingAdd(t *testing.T) {
+	s := &msg.Service{Name: strings.Repeat("TestService", 200), Host: "localhost", Port: 9000}
+	var puts int32
+	var reset bool
+	var mu sync.Mutex
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&puts, 1)
+		mu.Lock()
+		r := reset
+		mu.Unlock()
+		if r {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		if req.ContentLength != -1 {
+			t.Errorf("Expected a streamed body, got a length of %d", req.ContentLength)
+		}
+		body := io.Reader(req.Body)
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			z, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = z
+		}
+		var serv msg.Service
+		if err := json.NewDecoder(body).Decode(&serv); err != nil || serv.Name != s.Name || serv.Port != s.Port {
+			t.Errorf("Decoded service %+v differs from sent service %+v: %v", serv, *s, err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}, WithStreamingAdd(true))
+	defer ts.Close()
+
+	if err := c.Add("123", s); err != nil {
+		t.Fatal(err)
+	}
+	c.compress = true
+	if err := c.Add("123", s); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	reset = true
+	mu.Unlock()
+	atomic.StoreInt32(&puts, 0)
+	if err := c.Add("123", s); err == nil {
+		t.Fatal("Expected an error for a reset connection")
+	}
+	if n := atomic.LoadInt32(&puts); n != 1 {
+		t.Fatalf("Expected a streamed Add not to be retried, got %d PUTs", n)
+	}
+}
+
+func TestHTTPRetries(t *testing.T) {
+	var requests int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]*msg.Service{})
+	}, WithHTTPRetries(3), WithBackoff(ConstantBackoff(10*time.Millisecond)))
+	defer ts.Close()
+
+	if _, err := c.GetAllServices(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 || c.Stats().Retries != 2 {
+		t.Fatalf("Expected 3 requests and 2 retries, got %d and %d", n, c.Stats().Retries)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	c, err := NewClient(ts.URL, "", "skydns.local", "127.0.0.1:1", WithHTTPRetries(3), WithBackoff(ConstantBackoff(time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.GetAllServicesContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("Expected the backoff to stop at the deadline, took %v", d)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{Base: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if d := b.Next(attempt); d != want*time.Millisecond {
+			t.Errorf("Expected %v for attempt %d, got %v", want*time.Millisecond, attempt, d)
+		}
+	}
+	b.Jitter = true
+	for attempt := 0; attempt < 5; attempt++ {
+		if d := b.Next(attempt); d < 0 || d > b.Max {
+			t.Errorf("Expected a jittered wait up to %v, got %v", b.Max, d)
+		}
+	}
+}
+
+func TestAddWithExpiry(t *testing.T) {
+	var ttl uint32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		var serv msg.Service
+		json.NewDecoder(req.Body).Decode(&serv)
+		atomic.StoreUint32(&ttl, serv.TTL)
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer ts.Close()
+
+	s := &msg.Service{Host: "localhost", Port: 9000}
+	if err := c.AddWithExpiry("123", s, time.Now().Add(90*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadUint32(&ttl); got != 90 {
+		t.Fatalf("Expected a TTL of 90, got %d", got)
+	}
+	if err := c.AddWithExpiry("123", s, time.Now().Add(-time.Second)); err != ErrInvalidExpiry {
+		t.Fatalf("Expected ErrInvalidExpiry, got %v", err)
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	var stored []byte
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "PUT":
+			stored, _ = io.ReadAll(req.Body)
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			w.Write(stored)
+		}
+	})
+	defer ts.Close()
+
+	s := &msg.Service{Name: "web", Host: "10.0.0.1", Port: 80, TTL: 10}
+	SetMetadata(s, "route", "canary")
+	SetMetadata(s, "team", "edge")
+	if err := c.Add("123", s); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := GetMetadata(got, "route"); !ok || v != "canary" {
+		t.Fatalf("Expected route=canary, got %q, %v", v, ok)
+	}
+	if !ServiceEqual(s, got) {
+		t.Fatalf("Expected %+v, got %+v", s, got)
+	}
+	if _, ok := GetMetadata(got, "missing"); ok {
+		t.Fatal("Expected no value for a missing key")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	if _, err := NewClient(ts.URL, "secret", "skydns.local", "127.0.0.1:1", WithWarmup(true)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatal("Expected a warmup request in NewClient")
+	}
+	if _, err := NewClient(ts.URL, "wrong", "skydns.local", "127.0.0.1:1", WithWarmup(true)); err != nil {
+		t.Fatalf("Expected a failed warmup to be logged only, got %v", err)
+	}
+	if _, err := NewClient(ts.URL, "wrong", "skydns.local", "127.0.0.1:1", WithWarmup(true), WithRequireAuth(true)); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected ErrUnauthorized with WithRequireAuth, got %v", err)
+	}
+}
+
+func TestPayloadTooLarge(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "body exceeds 64KB", http.StatusRequestEntityTooLarge)
+	})
+	defer ts.Close()
+
+	s := &msg.Service{Host: "localhost", Port: 9000, Metadata: map[string]string{"blob": strings.Repeat("x", 1<<16)}}
+	errs := []error{
+		c.Add("123", s),
+		c.AddCallback("123", &msg.Callback{Name: "web", Reply: "localhost", Port: 8080}),
+		c.PatchService("123", map[string]interface{}{"Metadata": s.Metadata}),
+	}
+	for _, err := range errs {
+		var herr *HTTPError
+		if !errors.Is(err, ErrPayloadTooLarge) || !errors.As(err, &herr) || herr.Body != "body exceeds 64KB" {
+			t.Errorf("Expected ErrPayloadTooLarge with the server's limit, got %v", err)
+		}
+	}
+}
+
+func TestGetServicesModifiedSince(t *testing.T) {
+	since := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if got := req.URL.Query().Get("since"); got != "2014-01-02T03:04:05Z" {
+			t.Errorf("Expected since=2014-01-02T03:04:05Z, got %q", got)
+		}
+		json.NewEncoder(w).Encode([]*msg.Service{&msg.Service{UUID: "123"}})
+	})
+	defer ts.Close()
+
+	services, err := c.GetServicesModifiedSince(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("Expected 1 service, got %d", len(services))
+	}
+}
+
+func TestContentType(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "PUT":
+			if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected a Content-Type of application/json, got %q", ct)
+			}
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>502 Bad Gateway</body></html>"))
+		}
+	})
+	defer ts.Close()
+
+	if err := c.Add("123", &msg.Service{Host: "localhost", Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("123"); !errors.Is(err, ErrNotJSON) {
+		t.Fatalf("Expected ErrNotJSON, got %v", err)
+	}
+	if _, err := c.GetAllServices(); !errors.Is(err, ErrNotJSON) {
+		t.Fatalf("Expected ErrNotJSON, got %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		services = map[string]*msg.Service{"old": &msg.Service{UUID: "old", Name: "web", Host: "10.0.0.1", Port: 80}}
+		failGet  bool
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		uuid := strings.TrimPrefix(req.URL.Path, "/skydns/services/")
+		switch req.Method {
+		case "GET":
+			s, ok := services[uuid]
+			if !ok || (failGet && uuid == "newer") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(s)
+		case "PUT":
+			if _, ok := services[uuid]; ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			var s msg.Service
+			json.NewDecoder(req.Body).Decode(&s)
+			services[uuid] = &s
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			delete(services, uuid)
+		}
+	})
+	defer ts.Close()
+
+	if err := c.Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := services["old"]; ok || services["new"] == nil || services["new"].Host != "10.0.0.1" {
+		t.Fatalf("Expected the service to move to new, got %v", services)
+	}
+
+	services["other"] = &msg.Service{UUID: "other", Name: "db", Host: "10.0.0.2", Port: 5432}
+	if err := c.Rename("new", "other"); !errors.Is(err, ErrConflictingUUID) {
+		t.Fatalf("Expected ErrConflictingUUID, got %v", err)
+	}
+
+	failGet = true
+	if err := c.Rename("new", "newer"); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("Expected the unconfirmed rename to fail, got %v", err)
+	}
+	if _, ok := services["newer"]; ok || services["new"] == nil {
+		t.Fatalf("Expected the rename to be rolled back, got %v", services)
+	}
+}
+
+func TestSingleflight(t *testing.T) {
+	var requests int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(200 * time.Millisecond)
+		json.NewEncoder(w).Encode(&msg.Service{UUID: "123", Host: "localhost", Port: 9000, Metadata: map[string]string{"a": "b"}})
+	}, WithSingleflight(true))
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := c.Get("123")
+			if err != nil || s.Port != 9000 {
+				t.Errorf("Expected the service, got %v, %v", s, err)
+				return
+			}
+			SetMetadata(s, "a", "changed")
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected the calls to share 1 request, got %d", n)
+	}
+}
+
+func TestSingleflightHeaders(t *testing.T) {
+	var requests int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(200 * time.Millisecond)
+		port := 9000
+		if req.Header.Get("Authorization") == "other" {
+			port = 9001
+		}
+		json.NewEncoder(w).Encode(&msg.Service{UUID: "123", Host: "localhost", Port: uint16(port)})
+	}, WithSingleflight(true))
+	defer ts.Close()
+	c.secret = "secret"
+
+	var wg sync.WaitGroup
+	for i, auth := range []string{"", "other", "", "other"} {
+		wg.Add(1)
+		go func(i int, auth string) {
+			defer wg.Done()
+			ctx := context.Background()
+			want := uint16(9000)
+			if auth != "" {
+				ctx = WithRequestHeaders(ctx, http.Header{"Authorization": {auth}})
+				want = 9001
+			}
+			s, err := c.GetContext(ctx, "123")
+			if err != nil || s.Port != want {
+				t.Errorf("%d: Expected port %d, got %v, %v", i, want, s, err)
+			}
+		}(i, auth)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("Expected a request per Authorization, got %d", n)
+	}
+}
+
+func TestLenientNumbers(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/skydns/services/" {
+			w.Write([]byte(`[{"UUID":"1","Host":"a","Port":80,"TTL":30},{"UUID":"2","Host":"b","Port":" 81","TTL":"31","Name":"42"}]`))
+			return
+		}
+		w.Write([]byte(`{"UUID":"3","Host":"c","Port":"82","TTL":"32","Metadata":{"Port":"8080","TTL":"5"}}`))
+	}, WithLenientNumbers(true))
+	defer ts.Close()
+
+	services, err := c.GetAllServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].TTL != 30 || services[1].TTL != 31 || services[1].Port != 81 || services[1].Name != "42" {
+		t.Fatalf("Expected numeric and string TTLs to decode, got %+v %+v", services[0], services[1])
+	}
+	var streamed []*msg.Service
+	err = c.StreamAllServices(context.Background(), func(s *msg.Service) error {
+		streamed = append(streamed, s)
+		return nil
+	})
+	if err != nil || len(streamed) != 2 || streamed[1].TTL != 31 {
+		t.Fatalf("Expected string TTLs to stream, got %v, %v", streamed, err)
+	}
+	if s, err := c.Get("3"); err != nil || s.TTL != 32 || s.Port != 82 || s.Metadata["Port"] != "8080" || s.Metadata["TTL"] != "5" {
+		t.Fatalf("Expected TTL 32 and port 82 with the Metadata untouched, got %+v, %v", s, err)
+	}
+
+	c.lenient = false
+	if _, err := c.Get("3"); !errors.Is(err, ErrDecode) {
+		t.Fatalf("Expected ErrDecode without WithLenientNumbers, got %v", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{}, 1)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-req.Context().Done()
+	}, WithContext(parent))
+	defer ts.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.GetContext(context.Background(), "1")
+		errc <- err
+	}()
+	<-started
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Call not cancelled with the client context")
+	}
+
+	if _, err := c.GetAllServices(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected calls to fail after the client context is cancelled, got %v", err)
+	}
+	select {
+	case <-started:
+		t.Fatal("Request sent after the client context was cancelled")
+	default:
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	got := make(chan http.Header, 1)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		got <- req.Header.Clone()
+		w.Write([]byte(`{"UUID":"1"}`))
+	}, WithHeaders(http.Header{"Origin": {"https://app.example.com"}, "X-Requested-With": {"skydns"}}))
+	defer ts.Close()
+	c.secret = "secret"
+
+	ctx := WithRequestHeaders(context.Background(), http.Header{"X-Requested-With": {"wasm"}})
+	if _, err := c.GetContext(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	h := <-got
+	if h.Get("Origin") != "https://app.example.com" || h.Get("X-Requested-With") != "wasm" || h.Get("Authorization") != "secret" {
+		t.Fatalf("Expected the default, request and auth headers, got %v", h)
+	}
+
+	ctx = WithRequestHeaders(context.Background(), http.Header{"Authorization": {"token"}})
+	if _, err := c.GetContext(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if h := <-got; len(h["Authorization"]) != 1 || h.Get("Authorization") != "token" {
+		t.Fatalf("Expected the request Authorization to replace the secret, got %v", h["Authorization"])
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer ok.Close()
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer denied.Close()
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	c, err := NewClient(ok.URL, "secret", "skydns.local", addr, WithEndpoints([]WeightedEndpoint{
+		{Base: ok.URL, Weight: 1}, {Base: denied.URL, Weight: 1}, {Base: "http://127.0.0.1:1", Weight: 1},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.Diagnose(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Endpoints) != 3 {
+		t.Fatalf("Expected 3 endpoints, got %+v", report.Endpoints)
+	}
+	if e := report.Endpoints[0]; e.Base != ok.URL || !e.Reachable || !e.Authorized || e.Status != 200 || e.Err != nil || e.Latency <= 0 {
+		t.Errorf("Expected a healthy endpoint, got %+v", e)
+	}
+	if e := report.Endpoints[1]; !e.Reachable || e.Authorized || e.Status != 401 || !errors.Is(e.Err, ErrUnauthorized) {
+		t.Errorf("Expected an unauthorized endpoint, got %+v", e)
+	}
+	if e := report.Endpoints[2]; e.Reachable || e.Authorized || !errors.Is(e.Err, ErrUnreachable) {
+		t.Errorf("Expected an unreachable endpoint, got %+v", e)
+	}
+	if d := report.DNS; d.Server != addr || !d.Reachable || d.Rcode != dns.RcodeNameError || d.Err != nil || d.Latency <= 0 {
+		t.Errorf("Expected a reachable DNS server, got %+v", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report, err := c.Diagnose(ctx); err != context.Canceled || len(report.Endpoints) != 0 {
+		t.Fatalf("Expected context.Canceled and no endpoints, got %+v, %v", report, err)
+	}
+}
+
+func TestDecodeMangledBody(t *testing.T) {
+	var body string
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(body))
+	})
+	defer ts.Close()
+
+	body = "\xef\xbb\xbf" + `{"UUID":"123","Host":"localhost","Port":9000}`
+	s, err := c.Get("123")
+	if err != nil {
+		t.Fatalf("Expected the BOM to be skipped, got %v", err)
+	}
+	if s.Port != 9000 {
+		t.Fatalf("Expected port 9000, got %d", s.Port)
+	}
+
+	body = `{"UUID":"123","Host":"localh`
+	if _, err := c.Get("123"); !errors.Is(err, ErrDecode) || !strings.Contains(err.Error(), `localh`) {
+		t.Fatalf("Expected ErrDecode with the truncated bytes, got %v", err)
+	}
+}
+
+func TestAddMultiRegion(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		added = make(map[string]string)
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		uuid := strings.TrimPrefix(req.URL.Path, "/skydns/services/")
+		if uuid == "web-west" {
+			http.Error(w, "Service already exists in registry", http.StatusConflict)
+			return
+		}
+		var serv msg.Service
+		json.NewDecoder(req.Body).Decode(&serv)
+		mu.Lock()
+		added[uuid] = serv.Region
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer ts.Close()
+
+	errs, err := c.AddMultiRegion("web", &msg.Service{Name: "web", Host: "10.0.0.1", Port: 80}, []string{"east", "West"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs["east"] != nil || !errors.Is(errs["West"], ErrConflictingUUID) {
+		t.Fatalf("Expected east to be added and West to conflict, got %v", errs)
+	}
+	if added["web-east"] != "east" {
+		t.Fatalf("Expected web-east in region east, got %v", added)
+	}
+	if _, err := c.AddMultiRegion("web", &msg.Service{}, []string{"us.east"}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected ErrInvalidName, got %v", err)
+	}
+}
+
+func TestImportResume(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		puts = make(map[string]int)
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		uuid := strings.TrimPrefix(req.URL.Path, "/skydns/services/")
+		mu.Lock()
+		puts[uuid]++
+		n := puts[uuid]
+		mu.Unlock()
+		if uuid == "a" || n > 1 {
+			http.Error(w, "Service already exists in registry", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer ts.Close()
+
+	backup := `[{"UUID":"a","Port":80},{"UUID":"b","Port":80},{"UUID":"c","Port":80}]`
+	var progress int32
+	errs := c.ImportContext(context.Background(), strings.NewReader(backup), ImportOptions{
+		Concurrency: 2,
+		Resume:      true,
+		Progress:    func(done, total int) { atomic.AddInt32(&progress, 1) },
+	})
+	if len(errs) != 0 {
+		t.Fatalf("Expected existing services to be skipped, got %v", errs)
+	}
+	if atomic.LoadInt32(&progress) != 3 {
+		t.Fatalf("Expected 3 progress calls, got %d", progress)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs = c.ImportContext(ctx, strings.NewReader(backup), ImportOptions{Resume: true})
+	if len(errs) != 3 || !errors.Is(errs["b"], context.Canceled) {
+		t.Fatalf("Expected all services to be reported as canceled, got %v", errs)
+	}
+}
+
+func TestFieldDiff(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(&msg.Service{UUID: "123", Name: "web", Host: "10.0.0.1", Port: 80, TTL: 10})
+	})
+	defer ts.Close()
+
+	desired := &msg.Service{Name: "web", Host: "10.0.0.1", Port: 8080, TTL: 30, Metadata: map[string]string{}}
+	changes, err := c.FieldDiff("123", desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes["Port"] != (FieldChange{Old: uint16(80), New: uint16(8080)}) {
+		t.Fatalf("Expected only Port to change, got %v", changes)
+	}
+	desired.Port = 80
+	if changes, err := c.FieldDiff("123", desired); err != nil || len(changes) != 0 {
+		t.Fatalf("Expected no changes, got %v, %v", changes, err)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	var inFlight, peak int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		w.WriteHeader(http.StatusCreated)
+	}, WithMaxConcurrency(2))
+	defer ts.Close()
+
+	backup := `[{"UUID":"a"},{"UUID":"b"},{"UUID":"c"},{"UUID":"d"},{"UUID":"e"},{"UUID":"f"}]`
+	if errs := c.Import(strings.NewReader(backup), 6); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if p := atomic.LoadInt32(&peak); p > 2 {
+		t.Fatalf("Expected at most 2 requests in flight, got %d", p)
+	}
+}
+
+func TestLease(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		registered bool
+		deletes    int
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.Method {
+		case "PUT":
+			registered = true
+			w.WriteHeader(http.StatusCreated)
+		case "PATCH":
+			if !registered {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "DELETE":
+			deletes++
+			registered = false
+		}
+	})
+	defer ts.Close()
+
+	l, err := c.Acquire(context.Background(), "123", &msg.Service{Host: "localhost", Port: 9000}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l.Done():
+	default:
+		t.Fatal("Expected Done to be closed after Release")
+	}
+	if deletes != 1 || l.Err() != nil {
+		t.Fatalf("Expected 1 delete and no error, got %d, %v", deletes, l.Err())
+	}
+
+	l, err = c.Acquire(context.Background(), "123", &msg.Service{Host: "localhost", Port: 9000}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+	mu.Lock()
+	registered = false
+	mu.Unlock()
+	l.h.SetInterval(10 * time.Millisecond)
+	select {
+	case <-l.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the lease to end once the service is gone")
+	}
+	if !errors.Is(l.Err(), ErrServiceNotFound) {
+		t.Fatalf("Expected ErrServiceNotFound, got %v", l.Err())
+	}
+}
+
+func TestGetServicesProjected(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("fields") != "Host,Port" {
+			t.Errorf("Expected fields Host,Port, got %q", req.URL.Query().Get("fields"))
+		}
+		json.NewEncoder(w).Encode([]*msg.Service{&msg.Service{UUID: "1", Name: "web", Host: "10.0.0.1", Port: 80,
+			Metadata: map[string]string{"blob": "x"}}})
+	})
+	defer ts.Close()
+
+	services, err := c.GetServicesProjected([]string{"Host", "Port"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Host != "10.0.0.1" || services[0].Port != 80 ||
+		services[0].UUID != "" || services[0].Name != "" || services[0].Metadata != nil {
+		t.Fatalf("Expected only Host and Port, got %+v", services)
+	}
+	if _, err := c.GetServicesProjected([]string{"Hostname"}); err != ErrUnknownField {
+		t.Fatalf("Expected ErrUnknownField, got %v", err)
+	}
+}
+
+func TestGetServiceHistory(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/skydns/services/123/history" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(`[{"Time":"2026-01-02T03:04:05Z","Service":{"Host":"10.0.0.1","Port":80}},` +
+			`{"Time":"2026-02-02T03:04:05Z","Service":{"Host":"10.0.0.2","Port":80}}]`))
+	})
+	defer ts.Close()
+
+	revs, err := c.GetServiceHistory("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[1].Service.Host != "10.0.0.2" || revs[0].Time.Month() != time.January {
+		t.Fatalf("Expected two revisions, got %+v", revs)
+	}
+	if _, err := c.GetServiceHistory("456"); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestCountServices(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/skydns/regions/" {
+			t.Errorf("Expected only the regions to be fetched, got %s", req.URL.Path)
+		}
+		w.Write([]byte(`{"east":3,"west":2,"":1}`))
+	})
+	defer ts.Close()
+
+	n, err := c.CountServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Fatalf("Expected 6 services, got %d", n)
+	}
+}
+
+func TestGetRegionServices(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		query string
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		query = req.URL.Query().Get("query")
+		mu.Unlock()
+		// Ignore the query like a server that cannot filter.
+		w.Write([]byte(`[{"UUID":"1","Region":"east"},{"UUID":"2","Region":"west"},{"UUID":"3","Region":"East"}]`))
+	})
+	defer ts.Close()
+
+	services, err := c.GetRegionServices("east")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].UUID != "1" {
+		t.Fatalf("Expected the service in east, got %+v", services)
+	}
+	mu.Lock()
+	if query != "east.*.*.*" {
+		t.Errorf("Expected the query east.*.*.*, got %q", query)
+	}
+	mu.Unlock()
+	if _, err := c.GetRegionServices("us.east"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if query != "*.*.*.*" {
+		t.Errorf("Expected a region with a dot to query any, got %q", query)
+	}
+	mu.Unlock()
+}
+
+func TestGetServicesScoped(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		query string
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		query = req.URL.Query().Get("query")
+		mu.Unlock()
+		w.Write([]byte(`[{"UUID":"1","Region":"east","Environment":"production"},` +
+			`{"UUID":"2","Region":"east","Environment":"staging"},{"UUID":"3","Region":"west","Environment":"production"}]`))
+	})
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		region, environment, query, uuids string
+	}{
+		{"east", "production", "east.*.*.production", "1"},
+		{"", "production", "*.*.*.production", "1 3"},
+		{"east", "", "east.*.*.*", "1 2"},
+	} {
+		services, err := c.GetServicesScoped(tc.region, tc.environment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var uuids []string
+		for _, s := range services {
+			uuids = append(uuids, s.UUID)
+		}
+		mu.Lock()
+		q := query
+		mu.Unlock()
+		if q != tc.query || strings.Join(uuids, " ") != tc.uuids {
+			t.Errorf("%q, %q: Expected the query %s and services %s, got %s and %v", tc.region, tc.environment, tc.query, tc.uuids, q, uuids)
+		}
+	}
+}
+
+func TestEmptyResultsNotNil(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("null"))
+	})
+	defer ts.Close()
+
+	services, err := c.GetAllServices()
+	if err != nil || services == nil {
+		t.Fatalf("Expected an empty slice, got %v, %v", services, err)
+	}
+	scoped, err := c.GetServicesScoped("east", "")
+	if err != nil || scoped == nil {
+		t.Fatalf("Expected an empty slice, got %v, %v", scoped, err)
+	}
+	regions, err := c.GetRegions()
+	if err != nil || regions == nil {
+		t.Fatalf("Expected an empty map, got %v, %v", regions, err)
+	}
+	envs, err := c.GetEnvironments()
+	if err != nil || envs == nil {
+		t.Fatalf("Expected an empty map, got %v, %v", envs, err)
+	}
+}
+
+func TestGetRegionsStatus(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"east":1}`, http.StatusInternalServerError)
+	})
+	defer ts.Close()
+
+	var herr *HTTPError
+	if regions, err := c.GetRegions(); !errors.Is(err, ErrInvalidResponse) || !errors.As(err, &herr) || herr.StatusCode != http.StatusInternalServerError || regions != nil {
+		t.Fatalf("Expected ErrInvalidResponse for a 500, got %v, %v", regions, err)
+	}
+	if envs, err := c.GetEnvironments(); !errors.Is(err, ErrInvalidResponse) || !errors.As(err, &herr) || herr.StatusCode != http.StatusInternalServerError || envs != nil {
+		t.Fatalf("Expected ErrInvalidResponse for a 500, got %v, %v", envs, err)
+	}
+}
+
+func TestCachedResolver(t *testing.T) {
+	var gets int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		services := []*msg.Service{
+			&msg.Service{UUID: "1", Name: "web", Version: "1.0", Region: "east", Environment: "production", Host: "10.0.0.1", Port: 80},
+			&msg.Service{UUID: "2", Name: "db", Version: "1.0", Region: "east", Environment: "production", Host: "10.0.0.2", Port: 5432},
+		}
+		if atomic.AddInt32(&gets, 1) > 1 {
+			services = append(services,
+				&msg.Service{UUID: "3", Name: "web", Version: "2.0", Region: "west", Environment: "production", Host: "10.0.0.3", Port: 80})
+		}
+		json.NewEncoder(w).Encode(services)
+	})
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := c.NewCachedResolver(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Lookup("db.production"); len(got) != 1 || got[0].UUID != "2" {
+		t.Fatalf("Expected db from the initial fetch, got %v", got)
+	}
+	// The first poll of Watch follows right away and brings in service 3.
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.Lookup("web.production")) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected two web services after the first poll, got %v", r.Lookup("web.production"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := r.Lookup("west.*.web.production"); len(got) != 1 || got[0].UUID != "3" {
+		t.Fatalf("Expected the web service in west, got %v", got)
+	}
+	if got := r.Lookup("2-0.web.production"); len(got) != 1 || got[0].Version != "2.0" {
+		t.Fatalf("Expected web 2.0, got %v", got)
+	}
+	cancel()
+	<-r.Done()
+}
+
+func TestKeyFunc(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		deleted []string
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			w.Write([]byte(`[{"Name":"web","Host":"10.0.0.1","Port":80},{"Name":"db","Host":"10.0.0.2","Port":5432}]`))
+			return
+		}
+		mu.Lock()
+		deleted = append(deleted, req.Method+" "+req.URL.Path)
+		mu.Unlock()
+	}, WithKeyFunc(func(s *msg.Service) string { return s.Name }))
+	defer ts.Close()
+
+	m, err := c.GetAllServicesMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m["web"] == nil || m["db"] == nil {
+		t.Fatalf("Expected the services keyed by name, got %v", m)
+	}
+	n, err := c.DeleteWhere(func(s *msg.Service) bool { return s.Port == 80 })
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 deleted, got %d, %v", n, err)
+	}
+	mu.Lock()
+	got := strings.Join(deleted, ",")
+	mu.Unlock()
+	if got != "DELETE /skydns/services/web" {
+		t.Fatalf("Expected the delete to use the key in its path, got %q", got)
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		deleted []string
+		failing = true
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			w.Write([]byte(`[{"UUID":"1","Environment":"team-a"},{"UUID":"2","Environment":"team-b"},{"UUID":"3","Environment":"team-a"},{"UUID":"4","Environment":"team-a"}]`))
+			return
+		}
+		uuid := strings.TrimPrefix(req.URL.Path, "/skydns/services/")
+		switch uuid {
+		case "3":
+			w.WriteHeader(http.StatusNotFound)
+		case "4":
+			mu.Lock()
+			fail := failing
+			mu.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fallthrough
+		default:
+			mu.Lock()
+			deleted = append(deleted, uuid)
+			mu.Unlock()
+		}
+	})
+	defer ts.Close()
+
+	teamA := func(s *msg.Service) bool { return s.Environment == "team-a" }
+	n, err := c.DeleteWhereContext(context.Background(), teamA, 1)
+	if !errors.Is(err, ErrInvalidResponse) || n != 1 {
+		t.Fatalf("Expected 1 deleted and ErrInvalidResponse, got %d, %v", n, err)
+	}
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	n, err = c.DeleteWhere(teamA)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 deleted, got %d, %v", n, err)
+	}
+	mu.Lock()
+	for _, uuid := range deleted {
+		if uuid == "2" {
+			t.Errorf("Service 2 deleted, it does not match")
+		}
+	}
+	mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.DeleteWhereContext(ctx, teamA, 2); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	var deletes int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "DELETE" {
+			atomic.AddInt32(&deletes, 1)
+			return
+		}
+		w.Write([]byte(`{"UUID":"1","Name":"web","Host":"10.0.0.1","Port":80,"TTL":17}`))
+	})
+	defer ts.Close()
+
+	other := &msg.Service{Name: "web", Host: "10.0.0.2", Port: 80, TTL: 30}
+	if err := c.DeleteIfMatch("1", other); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	if n := atomic.LoadInt32(&deletes); n != 0 {
+		t.Fatalf("Expected no delete of a changed service, got %d", n)
+	}
+	if err := c.DeleteIfMatch("1", &msg.Service{Name: "web", Host: "10.0.0.1", Port: 80, TTL: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&deletes); n != 1 {
+		t.Fatalf("Expected 1 delete, got %d", n)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	const vendor = "application/vnd.skydns+json"
+	accept := make(chan string, 1)
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		accept <- req.Header.Get("Accept")
+		w.Header().Set("Content-Type", vendor+"; charset=utf-8")
+		w.Write([]byte(`{"UUID":"1","Host":"localhost","Port":80}`))
+	}
+	c, ts := newTestClient(t, handler)
+	defer ts.Close()
+	if _, err := c.Get("1"); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-accept; a != "application/json" {
+		t.Fatalf("Expected Accept: application/json, got %q", a)
+	}
+
+	c, ts2 := newTestClient(t, handler, WithAccept(vendor))
+	defer ts2.Close()
+	if s, err := c.Get("1"); err != nil || s.Port != 80 {
+		t.Fatalf("Expected the %s response to decode, got %+v, %v", vendor, s, err)
+	}
+	if a := <-accept; a != vendor {
+		t.Fatalf("Expected Accept: %s, got %q", vendor, a)
+	}
+
+	for _, mt := range []string{"application/x-protobuf", "text/html", "application/"} {
+		if _, err := NewClient(ts.URL, "", "skydns.local", "127.0.0.1:1", WithAccept(mt)); !errors.Is(err, ErrInvalidMediaType) {
+			t.Errorf("Expected ErrInvalidMediaType for %q, got %v", mt, err)
+		}
+	}
+}
+
+func TestGetAllServicesSorted(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`[null,{"UUID":"b"},null,{"UUID":"a"}]`))
+	})
+	defer ts.Close()
+
+	services, err := c.GetAllServicesSorted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].UUID != "a" || services[1].UUID != "b" {
+		t.Fatalf("Expected a and b without the nulls, got %v", services)
+	}
+}
+
+func TestGetServicesSorted(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		params url.Values
+		sorted bool
+	)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		params = req.URL.Query()
+		s := sorted
+		mu.Unlock()
+		if s {
+			w.Header().Set("X-Sorted-By", "TTL")
+			w.Write([]byte(`[{"UUID":"9","TTL":1}]`))
+			return
+		}
+		w.Write([]byte(`[{"UUID":"1","Host":"c","TTL":30},null,{"UUID":"2","Host":"a","TTL":10},{"UUID":"3","Host":"b","TTL":30},{"UUID":"4","Host":"d","TTL":20}]`))
+	})
+	defer ts.Close()
+
+	uuids := func(services []*msg.Service) string {
+		var s []string
+		for _, v := range services {
+			s = append(s, v.UUID)
+		}
+		return strings.Join(s, " ")
+	}
+	services, err := c.GetServicesSorted("Host", false, 0, 0)
+	if err != nil || uuids(services) != "2 3 1 4" {
+		t.Fatalf("Expected 2 3 1 4 by Host, got %s, %v", uuids(services), err)
+	}
+	services, err = c.GetServicesSorted("TTL", true, 1, 2)
+	if err != nil || uuids(services) != "3 4" {
+		t.Fatalf("Expected 3 4 for the second page by TTL descending, got %s, %v", uuids(services), err)
+	}
+	mu.Lock()
+	if params.Get("sort") != "TTL" || params.Get("order") != "desc" || params.Get("offset") != "1" || params.Get("limit") != "2" {
+		t.Errorf("Expected the sort and paging parameters, got %v", params)
+	}
+	mu.Unlock()
+	if services, err := c.GetServicesSorted("TTL", false, 10, 0); err != nil || len(services) != 0 {
+		t.Fatalf("Expected no services past the end, got %v, %v", services, err)
+	}
+
+	mu.Lock()
+	sorted = true
+	mu.Unlock()
+	if services, err := c.GetServicesSorted("TTL", false, 0, 1); err != nil || uuids(services) != "9" {
+		t.Fatalf("Expected the server's page as is, got %s, %v", uuids(services), err)
+	}
+	if _, err := c.GetServicesSorted("Metadata", false, 0, 0); !errors.Is(err, ErrUnknownField) {
+		t.Fatalf("Expected ErrUnknownField, got %v", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	var mu sync.Mutex
+	registry := map[string]*msg.Service{
+		"keep":   {UUID: "keep", Name: "web", Host: "10.0.0.1", Port: 80, TTL: 12},
+		"change": {UUID: "change", Name: "web", Host: "10.0.0.2", Port: 80, TTL: 30},
+		"stale":  {UUID: "stale", Name: "web", Host: "10.0.0.3", Port: 80, TTL: 30},
+	}
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		uuid := strings.TrimPrefix(req.URL.Path, "/skydns/services/")
+		switch req.Method {
+		case "GET":
+			if uuid == "" {
+				all := make([]*msg.Service, 0, len(registry))
+				for _, s := range registry {
+					all = append(all, s)
+				}
+				json.NewEncoder(w).Encode(all)
+				return
+			}
+			s, ok := registry[uuid]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(s)
+		case "PUT":
+			if uuid == "broken" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if _, ok := registry[uuid]; ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			var s msg.Service
+			json.NewDecoder(req.Body).Decode(&s)
+			s.UUID = uuid
+			registry[uuid] = &s
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			if _, ok := registry[uuid]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(registry, uuid)
+		}
+	})
+	defer ts.Close()
+
+	desired := map[string]*msg.Service{
+		"keep":    {Name: "web", Host: "10.0.0.1", Port: 80, TTL: 30},
+		"change":  {Name: "web", Host: "10.0.0.9", Port: 80, TTL: 30},
+		"new":     {Name: "web", Host: "10.0.0.4", Port: 80, TTL: 30},
+		"broken":  {Name: "web", Host: "10.0.0.5", Port: 80, TTL: 30},
+		"invalid": {Name: "web", Port: 80},
+	}
+	res, err := c.Reconcile(context.Background(), desired, ReconcileOptions{Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Added != 1 || res.Updated != 1 || res.Deleted != 0 || len(res.Errors) != 2 {
+		t.Fatalf("Expected 1 added, 1 updated and 2 errors, got %+v", res)
+	}
+	if !errors.Is(res.Errors["broken"], ErrInvalidResponse) || !errors.Is(res.Errors["invalid"], ErrNoHost) {
+		t.Fatalf("Expected errors for broken and invalid, got %v", res.Errors)
+	}
+	mu.Lock()
+	if registry["change"].Host != "10.0.0.9" || registry["new"] == nil || registry["stale"] == nil || registry["keep"].TTL != 12 {
+		t.Errorf("Unexpected registry after reconciling: %v", registry)
+	}
+	mu.Unlock()
+
+	delete(desired, "broken")
+	res, err = c.Reconcile(context.Background(), desired, ReconcileOptions{Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Added != 0 || res.Updated != 0 || res.Deleted != 1 || len(res.Errors) != 1 {
+		t.Fatalf("Expected only stale to be deleted, got %+v", res)
+	}
+	mu.Lock()
+	if registry["stale"] != nil || len(registry) != 3 {
+		t.Errorf("Expected keep, change and new to be left, got %v", registry)
+	}
+	mu.Unlock()
+
+	desired["keep"] = &msg.Service{Name: "web", Host: "10.0.0.1", Port: 80, TTL: 30, Metadata: map[string]string{"team": "a"}}
+	res, err = c.Reconcile(context.Background(), desired, ReconcileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Updated != 1 || len(res.Errors) != 1 {
+		t.Fatalf("Expected the Metadata change to be an update, got %+v", res)
+	}
+	mu.Lock()
+	if registry["keep"].Metadata["team"] != "a" {
+		t.Errorf("Expected the new Metadata to be registered, got %+v", registry["keep"])
+	}
+	mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Reconcile(ctx, desired, ReconcileOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestGetAllServicesStatus(t *testing.T) {
+	status := make(chan int, 1)
+	c, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(<-status)
+	})
+	defer ts.Close()
+
+	status <- http.StatusNotFound
+	if services, err := c.GetAllServices(); err != nil || services == nil || len(services) != 0 {
+		t.Fatalf("Expected an empty registry for a 404, got %v, %v", services, err)
+	}
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusUnauthorized} {
+		status <- code
+		services, err := c.GetAllServices()
+		var herr *HTTPError
+		if !errors.Is(err, ErrInvalidResponse) || !errors.As(err, &herr) || herr.StatusCode != code || services != nil {
+			t.Errorf("Expected ErrInvalidResponse for a %d, got %v, %v", code, services, err)
+		}
+	}
+}
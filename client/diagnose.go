@@ -0,0 +1,121 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// A DiagnosticReport is returned by Diagnose.
+type DiagnosticReport struct {
+	Endpoints []EndpointDiagnosis // in the order they were configured
+	DNS       DNSDiagnosis
+}
+
+// An EndpointDiagnosis holds the result of checking one HTTP endpoint.
+type EndpointDiagnosis struct {
+	Base       string
+	Reachable  bool // the server answered
+	Authorized bool // the server did not reject the client's secret
+	Status     int  // HTTP status code, zero if the server was not reached
+	Latency    time.Duration
+	Err        error // a *VerifyError, nil if the check succeeded
+}
+
+// A DNSDiagnosis holds the result of querying the DNS server.
+type DNSDiagnosis struct {
+	Server    string // DNS address, or the DoH endpoint with WithDoH
+	Reachable bool   // the server answered
+	Rcode     int
+	Latency   time.Duration
+	Err       error
+}
+
+// Diagnose checks every HTTP endpoint of the client like Verify, and the DNS
+// server with an SOA query for the domain, one after the other and without
+// retries, and reports their latency and state. Failed checks are recorded
+// in the report; the error is only set when ctx is done before all checks
+// finished, along with the partial report.
+func (c *Client) Diagnose(ctx context.Context) (*DiagnosticReport, error) {
+	bases := []string{c.base}
+	if c.endpoints != nil {
+		bases = bases[:0]
+		c.endpoints.Lock()
+		for _, e := range c.endpoints.eps {
+			bases = append(bases, e.base)
+		}
+		c.endpoints.Unlock()
+	}
+
+	report := &DiagnosticReport{}
+	for _, base := range bases {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Endpoints = append(report.Endpoints, c.diagnoseEndpoint(ctx, base))
+	}
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	report.DNS = c.diagnoseDNS(ctx)
+	return report, ctx.Err()
+}
+
+func (c *Client) diagnoseEndpoint(ctx context.Context, base string) EndpointDiagnosis {
+	d := EndpointDiagnosis{Base: base}
+	if callCtx, cancel := c.callContext(ctx); cancel != nil {
+		ctx = callCtx
+		defer cancel()
+	}
+	req, err := c.newRequestContext(ctx, "GET", fmt.Sprintf("%s/skydns/regions/", base), nil)
+	if err != nil {
+		d.Err = &VerifyError{Reason: ErrUnreachable, Err: err}
+		return d
+	}
+	start := time.Now()
+	resp, err := c.sendOnce(req)
+	d.Latency = time.Since(start)
+	if err != nil {
+		d.Err = &VerifyError{Reason: ErrUnreachable, Err: err}
+		return d
+	}
+	resp.Body.Close()
+
+	d.Reachable = true
+	d.Status = resp.StatusCode
+	d.Err = verifyStatus(resp.StatusCode)
+	d.Authorized = !errors.Is(d.Err, ErrUnauthorized)
+	return d
+}
+
+func (c *Client) diagnoseDNS(ctx context.Context) DNSDiagnosis {
+	d := DNSDiagnosis{Server: c.basedns}
+	if c.doh != "" {
+		d.Server = c.doh
+	}
+	m, err := c.newRequestDNS("", dns.TypeSOA)
+	if err != nil {
+		d.Err = err
+		return d
+	}
+	if callCtx, cancel := c.callContext(ctx); cancel != nil {
+		ctx = callCtx
+		defer cancel()
+	}
+	start := time.Now()
+	r, err := c.exchangeOnce(ctx, m)
+	d.Latency = time.Since(start)
+	if err != nil {
+		d.Err = err
+		return d
+	}
+	d.Reachable = true
+	d.Rcode = r.Rcode
+	return d
+}
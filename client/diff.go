@@ -0,0 +1,101 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"github.com/skynetservices/skydns1/msg"
+	"reflect"
+	"sort"
+)
+
+// DiffServices compares current with desired, both keyed by UUID or as by
+// Client.ServiceMap, and returns the services to add, the services to update
+// because they are not ServiceEqual and the sorted keys of the services to
+// delete.
+func DiffServices(current, desired map[string]*msg.Service) (toAdd, toUpdate map[string]*msg.Service, toDelete []string) {
+	toAdd = make(map[string]*msg.Service)
+	toUpdate = make(map[string]*msg.Service)
+	for uuid, d := range desired {
+		cur, ok := current[uuid]
+		switch {
+		case !ok:
+			toAdd[uuid] = d
+		case !ServiceEqual(cur, d):
+			toUpdate[uuid] = d
+		}
+	}
+	for uuid := range current {
+		if _, ok := desired[uuid]; !ok {
+			toDelete = append(toDelete, uuid)
+		}
+	}
+	sort.Strings(toDelete)
+	return toAdd, toUpdate, toDelete
+}
+
+// comparedFields are the Go names of the fields ServiceEqual compares.
+var comparedFields = []string{"Name", "Version", "Environment", "Region", "Host", "Port", "TTL", "NoExpire", "Metadata"}
+
+// A FieldChange is the old and new value of a field of a service.
+type FieldChange struct {
+	Old, New interface{}
+}
+
+// FieldDiff gets the service uuid and returns the fields, keyed by their
+// JSON name as used by PatchService, in which desired differs from it. Only
+// the fields ServiceEqual compares are considered, except for the TTL: the
+// server reports the time remaining, which would always differ. The map is
+// empty when nothing differs.
+func (c *Client) FieldDiff(uuid string, desired *msg.Service) (map[string]FieldChange, error) {
+	current, err := c.Get(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return diffFields(current, desired), nil
+}
+
+// diffFields returns the changes from a to b, leaving out the TTL.
+func diffFields(a, b *msg.Service) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for _, name := range comparedFields {
+		if name == "TTL" {
+			continue
+		}
+		fa, fb := va.FieldByName(name), vb.FieldByName(name)
+		if fa.Kind() == reflect.Map && fa.Len() == 0 && fb.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			changes[jsonName(va.Type(), name)] = FieldChange{Old: fa.Interface(), New: fb.Interface()}
+		}
+	}
+	return changes
+}
+
+// Diff compares n with an older snapshot old, as returned by GetRegions or
+// GetEnvironments, and returns the sorted names that appeared and
+// disappeared, and the names whose count changed with their old and new
+// count.
+func (n NameCount) Diff(old NameCount) (added, removed []string, changed map[string][2]int) {
+	changed = make(map[string][2]int)
+	for name, count := range n {
+		o, ok := old[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case o != count:
+			changed[name] = [2]int{o, count}
+		}
+	}
+	for name := range old {
+		if _, ok := n[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed, changed
+}
@@ -0,0 +1,605 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// exchange sends a DNS query to the DNS server and keeps the query counters.
+// A truncated UDP reply is retried over TCP. Timeouts and replies with a
+// retryable rcode, see RetryableRcode, are retried as often as the client is
+// configured to. With WithDNSSingleflight identical concurrent queries share
+// one exchange. With WithDoH the query is sent to the DoH endpoint instead.
+func (c *Client) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if callCtx, cancel := c.callContext(ctx); cancel != nil {
+		ctx = callCtx
+		defer cancel()
+	}
+	if c.dnsFlight == nil || len(m.Question) != 1 {
+		return c.exchangeRetry(ctx, m)
+	}
+
+	q := m.Question[0]
+	key := c.basedns + c.doh + "/" + strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype] + "/" + dns.ClassToString[q.Qclass]
+	// The shared exchange must not fail because the caller that started it
+	// went away, every caller waits for it as long as its own ctx allows.
+	ch := c.dnsFlight.DoChan(key, func() (interface{}, error) {
+		return c.exchangeRetry(context.WithoutCancel(ctx), m)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		r := res.Val.(*dns.Msg).Copy()
+		r.Id = m.Id
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// exchangeRetry does the exchange of m, retrying it as configured.
+func (c *Client) exchangeRetry(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	var (
+		r   *dns.Msg
+		err error
+	)
+	for attempt := 0; ; attempt++ {
+		r, err = c.exchangeOnce(ctx, m)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= c.dnsRetries || !retryableDNS(r, err) {
+			return r, err
+		}
+		if werr := c.wait(ctx, attempt); werr != nil {
+			return nil, werr
+		}
+		atomic.AddInt64(&c.stats.retries, 1)
+	}
+}
+
+func (c *Client) exchangeOnce(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt64(&c.stats.dnsQueries, 1)
+	if c.doh != "" {
+		r, err := c.exchangeDoH(ctx, m)
+		if err != nil {
+			atomic.AddInt64(&c.stats.dnsErrors, 1)
+		}
+		return r, err
+	}
+	if c.dnsConn != nil {
+		r, err := c.exchangePersistent(ctx, m)
+		if err != nil {
+			atomic.AddInt64(&c.stats.dnsErrors, 1)
+		}
+		return r, err
+	}
+	if c.dnsTCP {
+		r, err := c.exchangeWith(ctx, c.tcpClient(), m)
+		if err != nil {
+			atomic.AddInt64(&c.stats.dnsErrors, 1)
+		}
+		return r, err
+	}
+	r, err := c.exchangeWith(ctx, c.d, m)
+	if err == nil && r.Truncated && c.d.Net == "" {
+		atomic.AddInt64(&c.stats.dnsQueries, 1)
+		r, err = c.exchangeWith(ctx, c.tcpClient(), m)
+	}
+	if err != nil {
+		atomic.AddInt64(&c.stats.dnsErrors, 1)
+	}
+	return r, err
+}
+
+// RetryableRcode reports whether a DNS reply with rcode is worth retrying.
+// Only SERVFAIL is, as it signals a transient failure of the server. Other
+// rcodes, such as NXDOMAIN, are definitive answers.
+func RetryableRcode(rcode int) bool {
+	return rcode == dns.RcodeServerFailure
+}
+
+// retryableDNS reports whether an exchange that returned r and err should be
+// retried.
+func retryableDNS(r *dns.Msg, err error) bool {
+	if err != nil {
+		var ne net.Error
+		return errors.As(err, &ne) && ne.Timeout()
+	}
+	return RetryableRcode(r.Rcode)
+}
+
+// WaitUntilResolvable polls the DNS server every poll interval until an SRV
+// query for name, relative to the client's domain, returns at least one
+// answer. If ctx expires first, the last DNS error is returned, or the
+// context's error if every query succeeded without answers. A poll interval
+// of zero or less returns ErrInvalidInterval.
+func (c *Client) WaitUntilResolvable(ctx context.Context, name string, poll time.Duration) error {
+	if poll <= 0 {
+		return ErrInvalidInterval
+	}
+	tick := time.NewTicker(poll)
+	defer tick.Stop()
+
+	var last error
+	for {
+		req, err := c.newRequestDNS(name, dns.TypeSRV)
+		if err != nil {
+			return err
+		}
+		resp, err := c.exchange(ctx, req)
+		if err == nil && len(resp.Answer) > 0 {
+			return nil
+		}
+		if err != nil && ctx.Err() == nil {
+			last = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if last != nil {
+				return last
+			}
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// DeleteByName deletes the services an SRV query for name, relative to the
+// client's domain, returns and reports how many were deleted. SkyDNS only
+// encodes the UUID in the SRV target (as <uuid>.<domain>) for services that
+// registered an IP address as their host, services registered with a host
+// name can not be found this way. Records from other regions, which SkyDNS
+// adds with a higher priority, are ignored.
+func (c *Client) DeleteByName(name string) (int, error) {
+	req, err := c.newRequestDNS(name, dns.TypeSRV)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.exchange(context.Background(), req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return 0, nil
+	}
+
+	var (
+		prio  = uint16(0xFFFF)
+		uuids []string
+		seen  = make(map[string]bool)
+	)
+	for _, r := range resp.Answer {
+		if v, ok := r.(*dns.SRV); ok && v.Priority < prio {
+			prio = v.Priority
+		}
+	}
+	for _, r := range resp.Answer {
+		v, ok := r.(*dns.SRV)
+		if !ok || v.Priority != prio {
+			continue
+		}
+		uuid, ok := c.uuidFromTarget(v.Target)
+		if !ok || seen[uuid] {
+			continue
+		}
+		seen[uuid] = true
+		uuids = append(uuids, uuid)
+	}
+
+	n := 0
+	for _, uuid := range uuids {
+		if err := c.Delete(uuid); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// uuidFromTarget returns the UUID encoded in an SRV target of the form
+// <uuid>.<domain>.
+func (c *Client) uuidFromTarget(target string) (string, bool) {
+	uuid, _, _, err := ParseName(target, c.domain)
+	return uuid, err == nil && uuid != ""
+}
+
+// ParseName extracts the UUID, region and environment from fqdn, a name in
+// domain. SkyDNS names services as
+//
+//	<uuid>.<host>.<region>.<version>.<service>.<environment>.<domain>
+//
+// where names may leave out labels from the left, and any label may be a
+// "*" wildcard; components that are left out or wildcards are returned
+// empty. A name with a single label is the <uuid>.<domain> form SkyDNS uses
+// for SRV targets and A records, of which only the UUID is returned. Names
+// and domains are compared without regard to case.
+func ParseName(fqdn, domain string) (uuid, region, environment string, err error) {
+	name := strings.ToLower(dns.Fqdn(fqdn))
+	suffix := "." + strings.ToLower(dns.Fqdn(domain))
+	if !strings.HasSuffix(name, suffix) {
+		return "", "", "", ErrInvalidName
+	}
+	labels := dns.SplitDomainName(name[:len(name)-len(suffix)])
+	switch n := len(labels); {
+	case n == 0 || n > 6:
+		return "", "", "", ErrInvalidName
+	case n == 1:
+		return wildcard(labels[0]), "", "", nil
+	case n < 6:
+		labels = append(make([]string, 6-n), labels...)
+	}
+	return wildcard(labels[0]), wildcard(labels[2]), wildcard(labels[5]), nil
+}
+
+// wildcard returns label, or "" if it is a wildcard.
+func wildcard(label string) string {
+	if label == "*" {
+		return ""
+	}
+	return label
+}
+
+// Query sends a query for name, relative to the client's domain, and type
+// qtype to the DNS server and returns the reply as is. An empty name queries
+// the domain itself. Truncated replies are retried over TCP.
+func (c *Client) Query(name string, qtype uint16) (*dns.Msg, error) {
+	return c.QueryContext(context.Background(), name, qtype)
+}
+
+// QueryContext is like Query, but the query, including any retries, is
+// bound to ctx. When ctx expires the error is that of ctx.
+func (c *Client) QueryContext(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	req, err := c.newRequestDNS(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(ctx, req)
+}
+
+// QueryVia is like QueryContext, but the query is sent to server, a host:port
+// address, instead of the client's DNS server. Use ForDNSServer to send the
+// queries of the other DNS methods elsewhere.
+func (c *Client) QueryVia(ctx context.Context, server, name string, qtype uint16) (*dns.Msg, error) {
+	v, err := c.ForDNSServer(server)
+	if err != nil {
+		return nil, err
+	}
+	return v.QueryContext(ctx, name, qtype)
+}
+
+// LookupSRV returns the SRV records of name, relative to the client's domain,
+// in the order the server sent them, and how long they may be cached: the
+// lowest TTL of the answer records. It returns ErrServiceNotFound, with a
+// zero TTL, if there are none.
+func (c *Client) LookupSRV(ctx context.Context, name string) ([]*dns.SRV, time.Duration, error) {
+	resp, err := c.QueryContext(ctx, name, dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var srvs []*dns.SRV
+	for _, r := range resp.Answer {
+		if v, ok := r.(*dns.SRV); ok {
+			srvs = append(srvs, v)
+		}
+	}
+	if len(srvs) == 0 {
+		return nil, 0, ErrServiceNotFound
+	}
+	return srvs, time.Duration(answerTTL(resp.Answer)) * time.Second, nil
+}
+
+// Endpoints returns the sorted, distinct host:port addresses of the services
+// matching name, relative to the client's domain, such as web.production.
+// They come from an SRV query, with the addresses of services registered by
+// IP address taken from the additional section, so they include the
+// services SkyDNS adds from other regions. When the DNS server cannot be
+// queried the services are listed over HTTP instead and matched like
+// Resolver.Lookup does. It returns ErrServiceNotFound if there are none.
+func (c *Client) Endpoints(name string) ([]string, error) {
+	var services []*msg.Service
+	resp, err := c.Query(name, dns.TypeSRV)
+	if err == nil && resp.Rcode != dns.RcodeServerFailure {
+		services = c.servicesFromSRV(resp)
+	} else {
+		all, err := c.GetAllServices()
+		if err != nil {
+			return nil, err
+		}
+		labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+		for _, s := range all {
+			if matchLabels(strings.Split(serviceName(s), "."), labels) {
+				services = append(services, s)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	addrs := make([]string, 0, len(services))
+	for _, s := range services {
+		addr, err := ServiceAddr(s)
+		if err != nil || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, ErrServiceNotFound
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// answerTTL returns the lowest TTL of rrs, zero if there are none.
+func answerTTL(rrs []dns.RR) uint32 {
+	if len(rrs) == 0 {
+		return 0
+	}
+	ttl := rrs[0].Header().Ttl
+	for _, r := range rrs[1:] {
+		if t := r.Header().Ttl; t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+// LookupPrefix returns the services whose name starts with prefix, in
+// SkyDNS order: prefix holds the leftmost labels up to the service label,
+// such as "web" or "1-0-0.web", and the environment is a wildcard. So
+// LookupPrefix("web") sends an SRV query for web.*.<domain>, matching the
+// service web in every version, region and environment, and an empty
+// prefix matches all services. SkyDNS has no matching on part of a label.
+//
+// Services are built from the SRV records, including those SkyDNS adds from
+// other regions, and have their Host, Port and TTL set. Services that
+// registered an IP address also have their UUID set and the address, from
+// the additional section, as their Host. Large answers are retried over TCP.
+func (c *Client) LookupPrefix(prefix string) ([]*msg.Service, error) {
+	name := "*"
+	if prefix = strings.TrimSuffix(prefix, "."); prefix != "" {
+		if dns.CountLabel(prefix) > 5 {
+			return nil, ErrInvalidName
+		}
+		name = prefix + ".*"
+	}
+	resp, err := c.Query(name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	return c.servicesFromSRV(resp), nil
+}
+
+// servicesFromSRV builds services from the SRV records in resp, taking the
+// addresses of <uuid>.<domain> targets from the additional section.
+func (c *Client) servicesFromSRV(resp *dns.Msg) []*msg.Service {
+	addrs := make(map[string]string)
+	for _, r := range resp.Extra {
+		switch v := r.(type) {
+		case *dns.A:
+			addrs[strings.ToLower(v.Hdr.Name)] = v.A.String()
+		case *dns.AAAA:
+			addrs[strings.ToLower(v.Hdr.Name)] = v.AAAA.String()
+		}
+	}
+	services := make([]*msg.Service, 0, len(resp.Answer))
+	for _, r := range resp.Answer {
+		v, ok := r.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		s := SRVToService(v)
+		if addr, ok := addrs[strings.ToLower(v.Target)]; ok {
+			s.Host = addr
+			s.UUID, _ = c.uuidFromTarget(v.Target)
+		}
+		services = append(services, s)
+	}
+	return services
+}
+
+// tcpClient returns a copy of the DNS client that uses TCP.
+func (c *Client) tcpClient() *dns.Client {
+	t := *c.d
+	t.Net = "tcp"
+	if t.Dialer != nil {
+		if la, ok := t.Dialer.LocalAddr.(*net.UDPAddr); ok {
+			d := *t.Dialer
+			d.LocalAddr = &net.TCPAddr{IP: la.IP, Zone: la.Zone}
+			t.Dialer = &d
+		}
+	}
+	return &t
+}
+
+// GetDNS looks up the service with uuid over DNS. SkyDNS only answers this
+// for services that registered an IP address as their host, and only with
+// the address: the returned service has its UUID, Host and TTL, the lowest of
+// the answer records, set, but lacks the other fields, including the Port.
+// IPv4 addresses are preferred, unless
+// the address family is limited with WithAddressFamily.
+func (c *Client) GetDNS(uuid string) (*msg.Service, error) {
+	for _, qtype := range c.addressTypes() {
+		resp, err := c.Query(uuid, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Answer {
+			switch v := r.(type) {
+			case *dns.A:
+				return &msg.Service{UUID: uuid, Host: v.A.String(), TTL: answerTTL(resp.Answer)}, nil
+			case *dns.AAAA:
+				return &msg.Service{UUID: uuid, Host: v.AAAA.String(), TTL: answerTTL(resp.Answer)}, nil
+			}
+		}
+	}
+	return nil, ErrServiceNotFound
+}
+
+// GetResilient gets the service with uuid over HTTP and, when the HTTP
+// server can not be reached, falls back to GetDNS. Services returned by the
+// fallback are less complete, see GetDNS.
+func (c *Client) GetResilient(uuid string) (*msg.Service, error) {
+	s, err := c.Get(uuid)
+	if err == nil || !isConnError(err) {
+		return s, err
+	}
+	if d, derr := c.GetDNS(uuid); derr == nil {
+		return d, nil
+	}
+	return nil, err
+}
+
+// CheckConsistency fetches the service uuid over HTTP and over DNS and
+// reports whether both views agree on its Host and Port, as compared by
+// ServiceEqual. The DNS view comes from an SRV query for the service's full
+// SkyDNS name. A service missing from one view is inconsistent, and the
+// service of that view is nil; one missing from both is consistent.
+func (c *Client) CheckConsistency(uuid string) (bool, *msg.Service, *msg.Service, error) {
+	h, err := c.Get(uuid)
+	if errors.Is(err, ErrServiceNotFound) {
+		d, derr := c.GetDNS(uuid)
+		switch derr {
+		case nil:
+			return false, nil, d, nil
+		case ErrServiceNotFound:
+			return true, nil, nil, nil
+		default:
+			return false, nil, nil, derr
+		}
+	}
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	resp, err := c.Query(serviceName(h), dns.TypeSRV)
+	if err != nil {
+		return false, h, nil, err
+	}
+	var d *msg.Service
+	for _, s := range c.servicesFromSRV(resp) {
+		if s.UUID == "" || s.UUID == h.UUID {
+			d = s
+			break
+		}
+	}
+	if d == nil {
+		return false, h, nil, nil
+	}
+	return ServiceEqual(addrOnly(h), addrOnly(d)), h, d, nil
+}
+
+// serviceName returns the name of s relative to the domain, as SkyDNS
+// stores it.
+func serviceName(s *msg.Service) string {
+	return strings.ToLower(strings.Join([]string{s.UUID, strings.Replace(s.Host, ".", "-", -1), s.Region,
+		strings.Replace(s.Version, ".", "-", -1), s.Name, s.Environment}, "."))
+}
+
+// addrOnly returns a service with only the normalized Host and Port of s.
+func addrOnly(s *msg.Service) *msg.Service {
+	host := strings.ToLower(strings.TrimSuffix(s.Host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return &msg.Service{Host: host, Port: s.Port}
+}
+
+// isConnError reports whether err is a failure to reach a server.
+func isConnError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op)
+}
+
+// CanonicalString renders m in a stable form for logs, diffs and golden
+// tests: the random query ID is left out, names are lower cased and the
+// records of each section are sorted. It is not a valid master file.
+func CanonicalString(m *dns.Msg) string {
+	if m == nil {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, ";; opcode: %s, status: %s\n", dns.OpcodeToString[m.Opcode], dns.RcodeToString[m.Rcode])
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{m.Response, "qr"}, {m.Authoritative, "aa"}, {m.Truncated, "tc"}, {m.RecursionDesired, "rd"},
+		{m.RecursionAvailable, "ra"}, {m.Zero, "z"}, {m.AuthenticatedData, "ad"}, {m.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(&b, ";; flags: %s\n", strings.Join(flags, " "))
+
+	questions := make([]string, len(m.Question))
+	for i, q := range m.Question {
+		q.Name = strings.ToLower(q.Name)
+		questions[i] = q.String()
+	}
+	writeSection(&b, "QUESTION", questions)
+	for _, s := range []struct {
+		name string
+		rrs  []dns.RR
+	}{
+		{"ANSWER", m.Answer}, {"AUTHORITY", m.Ns}, {"ADDITIONAL", m.Extra},
+	} {
+		lines := make([]string, len(s.rrs))
+		for i, rr := range s.rrs {
+			lines[i] = canonicalRR(rr).String()
+		}
+		writeSection(&b, s.name, lines)
+	}
+	return b.String()
+}
+
+// writeSection writes the sorted lines of a section named name to b.
+func writeSection(b *strings.Builder, name string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	sort.Strings(lines)
+	fmt.Fprintf(b, ";; %s\n", name)
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+}
+
+// canonicalRR returns a copy of rr with its owner name, and the names in the
+// data of the types SkyDNS serves, lower cased.
+func canonicalRR(rr dns.RR) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	switch v := rr.(type) {
+	case *dns.SRV:
+		v.Target = strings.ToLower(v.Target)
+	case *dns.CNAME:
+		v.Target = strings.ToLower(v.Target)
+	case *dns.NS:
+		v.Ns = strings.ToLower(v.Ns)
+	case *dns.PTR:
+		v.Ptr = strings.ToLower(v.Ptr)
+	case *dns.MX:
+		v.Mx = strings.ToLower(v.Mx)
+	}
+	return rr
+}
@@ -0,0 +1,940 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDNSServer starts a DNS server on a random local port running
+// handler, it listens on UDP and TCP, and returns its address.
+func newTestDNSServer(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	var (
+		pc  net.PacketConn
+		l   net.Listener
+		err error
+	)
+	// The TCP port of a random UDP port may be taken, try another.
+	for i := 0; i < 10; i++ {
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	for _, s := range []*dns.Server{udp, tcp} {
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go s.ActivateAndServe()
+		<-started
+	}
+	return pc.LocalAddr().String(), func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+func newTestDNSClient(t *testing.T, addr string, opts ...Option) *Client {
+	c, err := NewClient("http://127.0.0.1:8080", "", "skydns.local", addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestWaitUntilResolvable(t *testing.T) {
+	var queries int32
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if atomic.AddInt32(&queries, 1) >= 3 {
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+				Priority: 10, Weight: 100, Port: 9000, Target: "web1.site.com."})
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	c := newTestDNSClient(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.WaitUntilResolvable(ctx, "testservice.production", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 3 {
+		t.Fatalf("Expected 3 queries, got %d", n)
+	}
+	if err := c.WaitUntilResolvable(ctx, "testservice.production", 0); err != ErrInvalidInterval {
+		t.Fatalf("Expected ErrInvalidInterval, got %v", err)
+	}
+}
+
+func TestQueryTruncated(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncated = true
+		} else {
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+				Priority: 10, Weight: 100, Port: 9000, Target: "web1.site.com."})
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	c := newTestDNSClient(t, addr)
+
+	resp, err := c.Query("testservice.production", dns.TypeSRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Truncated || len(resp.Answer) != 1 {
+		t.Fatalf("Expected the TCP reply with one answer, got %s", resp)
+	}
+}
+
+func TestGetResilient(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Name == "123.skydns.local." && req.Question[0].Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A: net.ParseIP("10.0.0.1")})
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	// Nothing listens on port 1, so HTTP fails to connect.
+	c, err := NewClient("http://127.0.0.1:1", "", "skydns.local", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.GetResilient("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UUID != "123" || s.Host != "10.0.0.1" || s.TTL != 10 {
+		t.Fatalf("Unexpected service from DNS: %+v", s)
+	}
+}
+
+func TestQueryRetries(t *testing.T) {
+	var queries int32
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		switch req.Question[0].Name {
+		case "flaky.skydns.local.":
+			if atomic.AddInt32(&queries, 1) < 3 {
+				m.SetRcode(req, dns.RcodeServerFailure)
+			} else {
+				m.SetReply(req)
+			}
+		default:
+			atomic.AddInt32(&queries, 1)
+			m.SetRcode(req, dns.RcodeNameError)
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	c := newTestDNSClient(t, addr, WithDNSRetries(3))
+
+	resp, err := c.Query("flaky", dns.TypeSRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || atomic.LoadInt32(&queries) != 3 {
+		t.Fatalf("Expected success after 3 queries, got %s after %d", dns.RcodeToString[resp.Rcode], queries)
+	}
+
+	atomic.StoreInt32(&queries, 0)
+	resp, err = c.Query("missing", dns.TypeSRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError || atomic.LoadInt32(&queries) != 1 {
+		t.Fatalf("Expected NXDOMAIN without retries, got %s after %d", dns.RcodeToString[resp.Rcode], queries)
+	}
+}
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		name                      string
+		uuid, region, environment string
+		err                       error
+	}{
+		{"123.skydns.local.", "123", "", "", nil},
+		{"123.skydns.local", "123", "", "", nil},
+		{"123.localhost.east.1-0-0.web.production.skydns.local.", "123", "east", "production", nil},
+		{"123.LocalHost.East.1-0-0.Web.Production.SkyDNS.Local.", "123", "east", "production", nil},
+		{"*.*.east.1-0-0.web.production.skydns.local.", "", "east", "production", nil},
+		{"east.1-0-0.web.production.skydns.local.", "", "east", "production", nil},
+		{"web.production.skydns.local.", "", "", "production", nil},
+		{"1.123.localhost.east.1-0-0.web.production.skydns.local.", "", "", "", ErrInvalidName},
+		{"skydns.local.", "", "", "", ErrInvalidName},
+		{"123.example.org.", "", "", "", ErrInvalidName},
+		{"123.myskydns.local.", "", "", "", ErrInvalidName},
+	}
+	for _, tc := range tests {
+		uuid, region, environment, err := ParseName(tc.name, "skydns.local")
+		if uuid != tc.uuid || region != tc.region || environment != tc.environment || err != tc.err {
+			t.Errorf("ParseName(%q) = %q, %q, %q, %v; want %q, %q, %q, %v", tc.name,
+				uuid, region, environment, err, tc.uuid, tc.region, tc.environment, tc.err)
+		}
+	}
+}
+
+func TestQueryContextDeadline(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(500 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	c := newTestDNSClient(t, addr, WithDNSRetries(3))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.QueryContext(ctx, "slow", dns.TypeSRV); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("Expected the query to abort after 20ms, took %v", d)
+	}
+}
+
+func TestLookupPrefix(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Name != "web.*.skydns.local." {
+			m.SetRcode(req, dns.RcodeNameError)
+			w.WriteMsg(m)
+			return
+		}
+		hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10}
+		m.Answer = append(m.Answer,
+			&dns.SRV{Hdr: hdr, Priority: 10, Weight: 50, Port: 80, Target: "123.skydns.local."},
+			&dns.SRV{Hdr: hdr, Priority: 10, Weight: 50, Port: 8080, Target: "web1.site.com."})
+		m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: "123.skydns.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A: net.ParseIP("10.0.0.1")})
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	c := newTestDNSClient(t, addr)
+
+	services, err := c.LookupPrefix("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services, got %d", len(services))
+	}
+	if s := services[0]; s.UUID != "123" || s.Host != "10.0.0.1" || s.Port != 80 {
+		t.Errorf("Expected 123 at 10.0.0.1:80, got %+v", s)
+	}
+	if s := services[1]; s.UUID != "" || s.Host != "web1.site.com" || s.Port != 8080 {
+		t.Errorf("Expected web1.site.com:8080, got %+v", s)
+	}
+}
+
+func TestDNSSingleflight(t *testing.T) {
+	var queries int32
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+			Priority: 10, Weight: 100, Port: 9000, Target: "web1.site.com."})
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	c := newTestDNSClient(t, addr, WithDNSSingleflight(true))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Query("hot", dns.TypeSRV)
+			if err != nil || len(resp.Answer) != 1 {
+				t.Errorf("Expected 1 answer, got %v, %v", resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("Expected the queries to share 1 exchange, got %d", n)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	var port uint32 = 80
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Name != "123.10-0-0-1.east.1-0.web.production.skydns.local." {
+			m.SetRcode(req, dns.RcodeNameError)
+			w.WriteMsg(m)
+			return
+		}
+		m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+			Priority: 10, Weight: 100, Port: uint16(atomic.LoadUint32(&port)), Target: "123.skydns.local."})
+		m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: "123.skydns.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A: net.ParseIP("10.0.0.1")})
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(&msg.Service{UUID: "123", Name: "web", Version: "1.0", Environment: "production",
+			Region: "east", Host: "10.0.0.1", Port: 80, TTL: 10})
+	}))
+	defer ts.Close()
+	c, err := NewClient(ts.URL, "", "skydns.local", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, h, d, err := c.CheckConsistency("123")
+	if err != nil || !ok || h == nil || d == nil {
+		t.Fatalf("Expected consistent views, got %v, %v, %v, %v", ok, h, d, err)
+	}
+	atomic.StoreUint32(&port, 8080)
+	if ok, _, d, err := c.CheckConsistency("123"); err != nil || ok || d.Port != 8080 {
+		t.Fatalf("Expected inconsistent views, got %v, %v, %v", ok, d, err)
+	}
+}
+
+func TestDeleteByName(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if strings.HasPrefix(req.Question[0].Name, "missing.") {
+			m.Rcode = dns.RcodeNameError
+			w.WriteMsg(m)
+			return
+		}
+		for _, rr := range []struct {
+			prio   uint16
+			target string
+		}{
+			{10, "a.skydns.local."},
+			{10, "A.skydns.local."}, // the same UUID again
+			{10, "b.skydns.local."},
+			{10, "web.example.com."}, // registered with a host name
+			{20, "c.skydns.local."},  // in another region
+		} {
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+				Priority: rr.prio, Weight: 100, Port: 80, Target: rr.target})
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	var (
+		mu      sync.Mutex
+		deleted []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "DELETE" {
+			t.Errorf("Unexpected %s %s", req.Method, req.URL.Path)
+			return
+		}
+		mu.Lock()
+		deleted = append(deleted, strings.TrimPrefix(req.URL.Path, "/skydns/services/"))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	c, err := NewClient(ts.URL, "", "skydns.local", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := c.DeleteByName("web.production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	got := strings.Join(deleted, " ")
+	mu.Unlock()
+	if n != 2 || got != "a b" {
+		t.Fatalf("Expected a and b to be deleted, got %d: %s", n, got)
+	}
+	if n, err := c.DeleteByName("missing.production"); err != nil || n != 0 {
+		t.Fatalf("Expected nothing deleted for NXDOMAIN, got %d, %v", n, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deleted) != 2 {
+		t.Fatalf("Expected no more deletes, got %v", deleted)
+	}
+}
+
+func TestDoH(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		buf, _ := io.ReadAll(req.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+			Priority: 10, Weight: 100, Port: 9000, Target: "web1.site.com."})
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	defer ts.Close()
+
+	c := newTestDNSClient(t, "127.0.0.1:1", WithDoH(ts.URL+"/dns-query"))
+	resp, err := c.Query("testservice.production", dns.TypeSRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != 9000 {
+		t.Fatalf("Expected the SRV record over DoH, got %v", resp.Answer)
+	}
+	if n := c.Stats().Requests; n != 1 {
+		t.Fatalf("Expected the DoH query to count as an HTTP request, got %d", n)
+	}
+
+	c = newTestDNSClient(t, "127.0.0.1:1", WithDoH(ts.URL+"/dns-query"), WithRateLimit(20, 1))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Query("testservice.production", dns.TypeSRV); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("Expected the DoH queries to be rate limited, took %s", d)
+	}
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("not dns"))
+	}))
+	defer bad.Close()
+	c = newTestDNSClient(t, "127.0.0.1:1", WithDoH(bad.URL+"/dns-query"))
+	if _, err := c.Query("testservice.production", dns.TypeSRV); !errors.Is(err, ErrInvalidResponse) {
+		t.Fatalf("Expected ErrInvalidResponse, got %v", err)
+	}
+	if _, err := NewClient("http://127.0.0.1:8080", "", "skydns.local", "127.0.0.1:1", WithDoH("resolver:443")); err != ErrInvalidDoH {
+		t.Fatalf("Expected ErrInvalidDoH, got %v", err)
+	}
+}
+
+func TestEDNSClientSubnet(t *testing.T) {
+	subnets := make(chan *dns.EDNS0_SUBNET, 1)
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		var got *dns.EDNS0_SUBNET
+		if o := req.IsEdns0(); o != nil {
+			for _, opt := range o.Option {
+				if e, ok := opt.(*dns.EDNS0_SUBNET); ok {
+					got = e
+				}
+			}
+		}
+		subnets <- got
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	_, ipnet, _ := net.ParseCIDR("192.0.2.77/24")
+	c := newTestDNSClient(t, addr, WithEDNSClientSubnet(ipnet))
+	if _, err := c.Query("testservice.production", dns.TypeSRV); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-subnets; got == nil || got.Family != 1 || got.SourceNetmask != 24 || !got.Address.Equal(net.ParseIP("192.0.2.0")) {
+		t.Fatalf("Expected a client subnet of 192.0.2.0/24, got %v", got)
+	}
+
+	if _, err := NewClient("http://127.0.0.1:8080", "", "skydns.local", addr, WithEDNSClientSubnet(nil)); err != ErrInvalidSubnet {
+		t.Fatalf("Expected ErrInvalidSubnet, got %v", err)
+	}
+	bad := &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(24, 32)}
+	if _, err := NewClient("http://127.0.0.1:8080", "", "skydns.local", addr, WithEDNSClientSubnet(bad)); err != ErrInvalidSubnet {
+		t.Fatalf("Expected ErrInvalidSubnet for a mismatched mask, got %v", err)
+	}
+}
+
+func TestQueryVia(t *testing.T) {
+	answer := func(port uint16) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+				Priority: 10, Weight: 100, Port: port, Target: "web1.site.com."})
+			w.WriteMsg(m)
+		}
+	}
+	internal, shutdown := newTestDNSServer(t, answer(1000))
+	defer shutdown()
+	external, shutdown2 := newTestDNSServer(t, answer(2000))
+	defer shutdown2()
+
+	c := newTestDNSClient(t, internal, WithDNSSingleflight(true))
+	for addr, port := range map[string]uint16{internal: 1000, external: 2000} {
+		resp, err := c.QueryVia(context.Background(), addr, "testservice.production", dns.TypeSRV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != port {
+			t.Fatalf("Expected port %d from %s, got %v", port, addr, resp.Answer)
+		}
+	}
+	for _, addr := range []string{"", "127.0.0.1", ":53", "127.0.0.1:0", "127.0.0.1:dns"} {
+		if _, err := c.QueryVia(context.Background(), addr, "testservice.production", dns.TypeSRV); err != ErrInvalidDNSServer {
+			t.Errorf("Expected ErrInvalidDNSServer for %q, got %v", addr, err)
+		}
+	}
+}
+
+func TestRawDomain(t *testing.T) {
+	names := make(chan string, 1)
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		names <- req.Question[0].Name
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	c, err := NewClient("http://127.0.0.1:8080", "", "-skydns.local.", addr, WithRawDomain(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Query("web", dns.TypeSRV); err != nil {
+		t.Fatal(err)
+	}
+	if name := <-names; name != "web-skydns.local." {
+		t.Fatalf("Expected the domain to be used verbatim, got %q", name)
+	}
+	if c.ForDomain("other").domain != "other" {
+		t.Fatalf("Expected ForDomain to keep the raw domain, got %q", c.ForDomain("other").domain)
+	}
+	if c := newTestDNSClient(t, addr); c.domain != "skydns.local." {
+		t.Fatalf("Expected the domain to be fully qualified by default, got %q", c.domain)
+	}
+}
+
+func TestQueryBatch(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		remotes = make(map[string]bool)
+	)
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		remotes[w.RemoteAddr().Network()+" "+w.RemoteAddr().String()] = true
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if strings.HasPrefix(req.Question[0].Name, "missing.") {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	queries := []Query{{"web", dns.TypeSRV}, {"missing", dns.TypeSRV}, {"db", dns.TypeA}}
+	for _, tcp := range []bool{true, false} {
+		mu.Lock()
+		remotes = make(map[string]bool)
+		mu.Unlock()
+		c := newTestDNSClient(t, addr, WithDNSOverTCP(tcp))
+		replies, errs := c.QueryBatch(context.Background(), queries)
+		for i, q := range queries {
+			if errs[i] != nil {
+				t.Fatal(errs[i])
+			}
+			if replies[i].Question[0].Name != q.Name+".skydns.local." {
+				t.Fatalf("Expected the reply to %s in order, got %v", q.Name, replies[i].Question)
+			}
+		}
+		if replies[1].Rcode != dns.RcodeNameError {
+			t.Fatalf("Expected NXDOMAIN for missing, got %s", dns.RcodeToString[replies[1].Rcode])
+		}
+		mu.Lock()
+		n := len(remotes)
+		mu.Unlock()
+		if tcp && n != 1 {
+			t.Fatalf("Expected a single TCP connection, got %v", remotes)
+		}
+		if !tcp && n != len(queries) {
+			t.Fatalf("Expected one UDP exchange per query, got %v", remotes)
+		}
+	}
+}
+
+func TestQueryBatchTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// Accept and never answer.
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := newTestDNSClient(t, l.Addr().String(), WithDNSOverTCP(true))
+	c.d.Timeout = 100 * time.Millisecond
+	done := make(chan []error, 1)
+	go func() {
+		_, errs := c.QueryBatch(context.Background(), []Query{{"web", dns.TypeSRV}})
+		done <- errs
+	}()
+	select {
+	case errs := <-done:
+		if errs[0] == nil {
+			t.Fatal("Expected the unanswered query to fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("QueryBatch did not time out")
+	}
+}
+
+func TestCanonicalString(t *testing.T) {
+	srv := func(name, target string, port uint16) dns.RR {
+		return &dns.SRV{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+			Priority: 10, Weight: 50, Port: port, Target: target}
+	}
+	a := new(dns.Msg)
+	a.SetQuestion("Web.Skydns.Local.", dns.TypeSRV)
+	a.Response = true
+	a.Answer = []dns.RR{srv("Web.Skydns.Local.", "B.skydns.local.", 81), srv("web.skydns.local.", "a.skydns.local.", 80)}
+	b := new(dns.Msg)
+	b.SetQuestion("web.skydns.local.", dns.TypeSRV)
+	b.Response = true
+	b.Answer = []dns.RR{srv("web.skydns.local.", "a.skydns.local.", 80), srv("web.skydns.local.", "b.skydns.local.", 81)}
+
+	if CanonicalString(a) != CanonicalString(b) {
+		t.Fatalf("Expected equal renderings, got\n%s\nand\n%s", CanonicalString(a), CanonicalString(b))
+	}
+	want := ";; opcode: QUERY, status: NOERROR\n;; flags: qr rd\n;; QUESTION\n;web.skydns.local.\tIN\t SRV\n;; ANSWER\n" +
+		"web.skydns.local.\t10\tIN\tSRV\t10 50 80 a.skydns.local.\nweb.skydns.local.\t10\tIN\tSRV\t10 50 81 b.skydns.local.\n"
+	if got := CanonicalString(a); got != want {
+		t.Fatalf("Expected\n%q, got\n%q", want, got)
+	}
+	if a.Answer[0].Header().Name != "Web.Skydns.Local." {
+		t.Fatal("Expected the message to be left unchanged")
+	}
+}
+
+func TestResolveHostFamily(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: req.Question[0].Qtype, Class: dns.ClassINET, Ttl: 10}
+		switch req.Question[0].Qtype {
+		case dns.TypeA:
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.ParseIP("10.0.0.1")}, &dns.A{Hdr: hdr, A: net.ParseIP("10.0.0.2")}}
+		case dns.TypeAAAA:
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")}}
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	for family, want := range map[AddressFamily]string{
+		DualStack: "2001:db8::1 10.0.0.1 10.0.0.2",
+		IPv4:      "10.0.0.1 10.0.0.2",
+		IPv6:      "2001:db8::1",
+	} {
+		c := newTestDNSClient(t, addr, WithAddressFamily(family))
+		ips, err := c.ResolveHost(context.Background(), "123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("Expected %s for family %d, got %v", want, family, got)
+		}
+	}
+	c := newTestDNSClient(t, addr, WithAddressFamily(IPv6))
+	if s, err := c.GetDNS("123"); err != nil || s.Host != "2001:db8::1" {
+		t.Fatalf("Expected the IPv6 address, got %v, %v", s, err)
+	}
+	if _, err := NewClient("http://127.0.0.1:8080", "", "skydns.local", addr, WithAddressFamily(7)); err != ErrInvalidFamily {
+		t.Fatalf("Expected ErrInvalidFamily, got %v", err)
+	}
+}
+
+func TestDNSWireTap(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+			Priority: 10, Weight: 100, Port: 9000, Target: "web1.site.com."})
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	var (
+		mu    sync.Mutex
+		pairs [][2]*dns.Msg
+	)
+	tap := WithDNSWireTap(func(sent, received []byte) {
+		q, r := new(dns.Msg), new(dns.Msg)
+		if err := q.Unpack(sent); err != nil {
+			t.Errorf("Sent bytes do not unpack: %v", err)
+		}
+		if err := r.Unpack(received); err != nil {
+			t.Errorf("Received bytes do not unpack: %v", err)
+		}
+		mu.Lock()
+		pairs = append(pairs, [2]*dns.Msg{q, r})
+		mu.Unlock()
+	})
+	for _, opts := range [][]Option{{tap}, {tap, WithDNSOverTCP(true)}} {
+		mu.Lock()
+		pairs = nil
+		mu.Unlock()
+		c := newTestDNSClient(t, addr, opts...)
+		resp, err := c.QueryContext(context.Background(), "web.production", dns.TypeSRV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != 9000 {
+			t.Fatalf("Expected the tapped reply to parse as usual, got %v", resp.Answer)
+		}
+		replies, errs := c.QueryBatch(context.Background(), []Query{{"a.production", dns.TypeSRV}, {"b.production", dns.TypeSRV}})
+		for i, err := range errs {
+			if err != nil || len(replies[i].Answer) != 1 {
+				t.Fatalf("Expected batch reply %d, got %v, %v", i, replies[i], err)
+			}
+		}
+
+		mu.Lock()
+		if len(pairs) != 3 {
+			t.Fatalf("Expected 3 tapped exchanges, got %d", len(pairs))
+		}
+		for _, p := range pairs {
+			if p[0].Id != p[1].Id || p[0].Question[0].Name != p[1].Question[0].Name {
+				t.Errorf("Tapped reply %v does not answer query %v", p[1].Question, p[0].Question)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func TestAnswerTTL(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if strings.HasPrefix(q.Name, "missing.") {
+			w.WriteMsg(m)
+			return
+		}
+		hdr := func(ttl uint32) dns.RR_Header {
+			return dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		}
+		switch q.Qtype {
+		case dns.TypeSRV:
+			m.Answer = []dns.RR{
+				&dns.SRV{Hdr: hdr(30), Priority: 10, Weight: 50, Port: 80, Target: "a.site.com."},
+				&dns.SRV{Hdr: hdr(20), Priority: 10, Weight: 50, Port: 81, Target: "b.site.com."},
+			}
+		case dns.TypeA:
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr(40), A: net.ParseIP("10.0.0.1")}, &dns.A{Hdr: hdr(25), A: net.ParseIP("10.0.0.2")}}
+		case dns.TypeAAAA:
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr(15), AAAA: net.ParseIP("2001:db8::1")}}
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	c := newTestDNSClient(t, addr)
+	ctx := context.Background()
+
+	srvs, ttl, err := c.LookupSRV(ctx, "web.production")
+	if err != nil || len(srvs) != 2 || srvs[1].Port != 81 || ttl != 20*time.Second {
+		t.Fatalf("Expected 2 records with a TTL of 20s, got %v, %s, %v", srvs, ttl, err)
+	}
+	ips, ttl, err := c.ResolveHostTTL(ctx, "123")
+	if err != nil || len(ips) != 3 || ttl != 15*time.Second {
+		t.Fatalf("Expected 3 addresses with a TTL of 15s, got %v, %s, %v", ips, ttl, err)
+	}
+	if s, err := c.GetDNS("123"); err != nil || s.TTL != 25 {
+		t.Fatalf("Expected a TTL of 25, got %+v, %v", s, err)
+	}
+	if _, ttl, err := c.LookupSRV(ctx, "missing"); !errors.Is(err, ErrServiceNotFound) || ttl != 0 {
+		t.Fatalf("Expected ErrServiceNotFound and no TTL, got %s, %v", ttl, err)
+	}
+	if _, ttl, err := c.ResolveHostTTL(ctx, "missing"); !errors.Is(err, ErrServiceNotFound) || ttl != 0 {
+		t.Fatalf("Expected ErrServiceNotFound and no TTL, got %s, %v", ttl, err)
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	accepts int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepts, 1)
+	}
+	return conn, err
+}
+
+func TestPersistentDNSConn(t *testing.T) {
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingListener{Listener: tl}
+	srv := &dns.Server{Listener: l, IdleTimeout: func() time.Duration { return 200 * time.Millisecond },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10},
+				Priority: 10, Weight: 100, Port: 9000, Target: "web1.site.com."})
+			w.WriteMsg(m)
+		})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	c := newTestDNSClient(t, tl.Addr().String(), WithPersistentDNSConn(true))
+	for i := 0; i < 50; i++ {
+		resp, err := c.QueryContext(context.Background(), "web.production", dns.TypeSRV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("Expected 1 answer, got %v", resp.Answer)
+		}
+	}
+	if n := atomic.LoadInt32(&l.accepts); n != 1 {
+		t.Fatalf("Expected 50 queries on 1 connection, got %d connections", n)
+	}
+
+	// The server closes the idle connection, the next query reconnects.
+	time.Sleep(400 * time.Millisecond)
+	if _, err := c.QueryContext(context.Background(), "web.production", dns.TypeSRV); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&l.accepts); n != 2 {
+		t.Fatalf("Expected a new connection after the idle one was closed, got %d connections", n)
+	}
+	if err := c.CloseDNS(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryContext(context.Background(), "web.production", dns.TypeSRV); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&l.accepts); n != 3 {
+		t.Fatalf("Expected a new connection after CloseDNS, got %d connections", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := c.QueryContext(context.Background(), "web.production", dns.TypeSRV); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&l.accepts); n != 3 {
+		t.Fatalf("Expected concurrent queries to share the connection, got %d connections", n)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	addr, shutdown := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		name := req.Question[0].Name
+		if strings.HasPrefix(name, "missing.") {
+			m.Rcode = dns.RcodeNameError
+			w.WriteMsg(m)
+			return
+		}
+		hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 10}
+		m.Answer = []dns.RR{
+			&dns.SRV{Hdr: hdr, Priority: 10, Weight: 50, Port: 80, Target: "web2.site.com."},
+			&dns.SRV{Hdr: hdr, Priority: 10, Weight: 50, Port: 80, Target: "123.skydns.local."},
+			&dns.SRV{Hdr: hdr, Priority: 20, Weight: 100, Port: 80, Target: "web2.site.com."},
+		}
+		m.Extra = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "123.skydns.local.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 10},
+			AAAA: net.ParseIP("2001:db8::1")}}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	c := newTestDNSClient(t, addr)
+	addrs, err := c.Endpoints("web.production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(addrs, " "); got != "[2001:db8::1]:80 web2.site.com:80" {
+		t.Fatalf("Expected the SRV endpoints, got %s", got)
+	}
+	if _, err := c.Endpoints("missing.production"); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("Expected ErrServiceNotFound, got %v", err)
+	}
+
+	h, ts := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`[{"UUID":"1","Name":"web","Environment":"production","Host":"10.0.0.2","Port":80},
+			{"UUID":"2","Name":"web","Environment":"production","Host":"10.0.0.1","Port":81},
+			{"UUID":"3","Name":"db","Environment":"production","Host":"10.0.0.3","Port":5432}]`))
+	})
+	defer ts.Close()
+	addrs, err = h.Endpoints("web.production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(addrs, " "); got != "10.0.0.1:81 10.0.0.2:80" {
+		t.Fatalf("Expected the endpoints listed over HTTP, got %s", got)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// dnsConn is the persistent TCP connection to the DNS server. Queries hold
+// the lock for their exchange, so they are sent one at a time.
+type dnsConn struct {
+	sync.Mutex
+	conn *dns.Conn
+	buf  []byte
+}
+
+// WithPersistentDNSConn makes the client send its DNS queries over a single
+// TCP connection to the DNS server, kept open between queries, instead of
+// opening a connection or using UDP per query. Queries take turns on the
+// connection. When it fails it is closed and the next query opens a new one;
+// a query whose connection, used before, was closed or reset is sent once
+// more on a new one, as the server may have closed it while idle. Use
+// CloseDNS to close the connection. It has no effect with WithDoH.
+func WithPersistentDNSConn(persistent bool) Option {
+	return func(c *Client) error {
+		c.dnsConn = nil
+		if persistent {
+			c.dnsConn = &dnsConn{}
+		}
+		return nil
+	}
+}
+
+// CloseDNS closes the persistent DNS connection of WithPersistentDNSConn, if
+// one is open. A later query opens a new one.
+func (c *Client) CloseDNS() error {
+	if c.dnsConn == nil {
+		return nil
+	}
+	c.dnsConn.Lock()
+	defer c.dnsConn.Unlock()
+	if c.dnsConn.conn == nil {
+		return nil
+	}
+	err := c.dnsConn.conn.Close()
+	c.dnsConn.conn = nil
+	return err
+}
+
+// exchangePersistent exchanges m over the persistent DNS connection.
+func (c *Client) exchangePersistent(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	p := c.dnsConn
+	p.Lock()
+	defer p.Unlock()
+
+	reused := p.conn != nil
+	r, err := c.exchangeConn(ctx, p, m)
+	if err != nil && reused && isConnReset(err) {
+		r, err = c.exchangeConn(ctx, p, m)
+	}
+	return r, err
+}
+
+// exchangeConn exchanges m over the connection of p, opening it if there is
+// none, and closes it on failure. p must be locked.
+func (c *Client) exchangeConn(ctx context.Context, p *dnsConn, m *dns.Msg) (*dns.Msg, error) {
+	if p.conn == nil {
+		conn, err := c.tcpClient().DialContext(ctx, c.basedns)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+		p.buf = make([]byte, dns.MaxMsgSize)
+	}
+	r, err := c.exchangeOn(ctx, p.conn, p.buf, m)
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return r, err
+}
+
+// exchangeOn writes m to conn and reads its reply into buf, passing both to
+// the wire tap if there is one.
+func (c *Client) exchangeOn(ctx context.Context, conn *dns.Conn, buf []byte, m *dns.Msg) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		timeout := c.d.Timeout
+		if timeout == 0 {
+			timeout = dnsTimeout
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetDeadline(deadline)
+	// Unblock the read below when ctx is canceled.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	sent, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var received []byte
+	if c.wireTap != nil {
+		defer func() { c.wireTap(sent, received) }()
+	}
+	if _, err := conn.Write(sent); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+		received = buf[:n]
+		r := new(dns.Msg)
+		if err := r.Unpack(received); err != nil {
+			return nil, err
+		}
+		// Like the dns package, skip stray replies to other queries.
+		if r.Id != m.Id {
+			received = nil
+			continue
+		}
+		return r, nil
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/miekg/dns"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// dohMediaType is the media type of DNS messages sent over HTTPS, RFC 8484.
+const dohMediaType = "application/dns-message"
+
+// WithDoH makes the client send its DNS queries over HTTPS to endpoint, e.g.
+// https://resolver.example.com/dns-query, instead of to the DNS address given
+// to NewClient. Queries are POSTed as application/dns-message using the
+// client's HTTP client, so its transport and proxy apply, and count as HTTP
+// requests for the rate limit, WithMaxConcurrency, Stats and the observer.
+// Retries and singleflight work as they do for plain DNS.
+func WithDoH(endpoint string) Option {
+	return func(c *Client) error {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return ErrInvalidDoH
+		}
+		c.doh = u.String()
+		return nil
+	}
+}
+
+// exchangeDoH sends m to the DoH endpoint and decodes the reply.
+func (c *Client) exchangeDoH(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if c.wireTap != nil {
+		defer func() { c.wireTap(buf, body) }()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.doh, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := c.sendOnce(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPError(resp, ErrInvalidResponse)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != dohMediaType {
+		return nil, newHTTPError(resp, ErrInvalidResponse)
+	}
+	body, err = io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	if r.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return r, nil
+}
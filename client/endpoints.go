@@ -0,0 +1,132 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// endpointBackoff is how long an endpoint that failed to connect is left out
+// before it is tried again.
+const endpointBackoff = 5 * time.Second
+
+// A WeightedEndpoint is a SkyDNS server that read requests are spread over.
+type WeightedEndpoint struct {
+	Base   string // HTTP address, as given to NewClient
+	Weight int    // share of the read requests, at least 1
+}
+
+// endpointSet picks endpoints by smooth weighted round-robin, it is shared
+// between copies of a Client.
+type endpointSet struct {
+	sync.Mutex
+	eps []*endpoint
+}
+
+type endpoint struct {
+	base      string
+	weight    int
+	current   int
+	downUntil time.Time
+}
+
+// WithEndpoints spreads read requests over endpoints in proportion to their
+// weights. Mutating requests go to the first endpoint, or to the leader with
+// WithFollowLeader. An endpoint that cannot be connected to is left out for a
+// while and the request is tried on the next one; once the backoff expires
+// the endpoint is probed again by the next request it is picked for.
+func WithEndpoints(endpoints []WeightedEndpoint) Option {
+	return func(c *Client) error {
+		if len(endpoints) == 0 {
+			return ErrInvalidEndpoints
+		}
+		set := &endpointSet{}
+		for _, e := range endpoints {
+			if e.Base == "" || e.Weight < 1 {
+				return ErrInvalidEndpoints
+			}
+			set.eps = append(set.eps, &endpoint{base: e.Base, weight: e.Weight})
+		}
+		c.base = endpoints[0].Base
+		c.endpoints = set
+		return nil
+	}
+}
+
+// next returns the endpoint to send a request to, skipping those in tried.
+// Healthy endpoints are picked by weight; when none is left the endpoint
+// that has been down longest is probed. It returns nil when all endpoints
+// were tried.
+func (s *endpointSet) next(tried map[*endpoint]bool) *endpoint {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	var best, probe *endpoint
+	total := 0
+	for _, e := range s.eps {
+		if tried[e] {
+			continue
+		}
+		if now.Before(e.downUntil) {
+			if probe == nil || e.downUntil.Before(probe.downUntil) {
+				probe = e
+			}
+			continue
+		}
+		e.current += e.weight
+		total += e.weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	if best == nil {
+		return probe
+	}
+	best.current -= total
+	return best
+}
+
+func (s *endpointSet) markDown(e *endpoint) {
+	s.Lock()
+	e.downUntil = time.Now().Add(endpointBackoff)
+	s.Unlock()
+}
+
+func (s *endpointSet) markUp(e *endpoint) {
+	s.Lock()
+	e.downUntil = time.Time{}
+	s.Unlock()
+}
+
+// doEndpoints sends a read request to the endpoints in turn until one can be
+// connected to.
+func (c *Client) doEndpoints(req *http.Request) (*http.Response, error) {
+	tried := make(map[*endpoint]bool)
+	var err error
+	for {
+		e := c.endpoints.next(tried)
+		if e == nil {
+			return nil, err
+		}
+		tried[e] = true
+
+		r := req.Clone(req.Context())
+		if err := retarget(r, e.base); err != nil {
+			return nil, err
+		}
+		var resp *http.Response
+		resp, err = c.send(r)
+		if err == nil {
+			c.endpoints.markUp(e)
+			return resp, nil
+		}
+		if !isConnError(err) || req.Context().Err() != nil {
+			return nil, err
+		}
+		c.endpoints.markDown(e)
+	}
+}
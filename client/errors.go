@@ -0,0 +1,52 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBody is how much of a response body an HTTPError keeps.
+const maxErrorBody = 512
+
+// An HTTPError is returned when the server answers with a status that is an
+// error, like a 404 for a missing service. It wraps the sentinel error for
+// the status, such as ErrServiceNotFound or ErrInvalidResponse, so test for
+// those with errors.Is.
+type HTTPError struct {
+	Method     string
+	URL        string // final URL of the request, after redirects, without credentials
+	StatusCode int
+	Body       string // start of the response body, if any
+	Err        error
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("%s: %s %s: %d %s", e.Err, e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Body == "" {
+		return msg
+	}
+	return msg + ": " + e.Body
+}
+
+func (e *HTTPError) Unwrap() error { return e.Err }
+
+// newHTTPError returns an HTTPError for resp wrapping err. It reads the start
+// of the body, the caller still has to close it.
+func newHTTPError(resp *http.Response, err error) *HTTPError {
+	e := &HTTPError{StatusCode: resp.StatusCode, Err: err}
+	if req := resp.Request; req != nil {
+		e.Method = req.Method
+		e.URL = req.URL.Redacted()
+	}
+	if resp.Body != nil {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		e.Body = strings.TrimSpace(string(b))
+	}
+	return e
+}
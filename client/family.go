@@ -0,0 +1,103 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// An AddressFamily selects the addresses ResolveHost and GetDNS return.
+type AddressFamily int
+
+const (
+	// DualStack returns IPv6 and IPv4 addresses, interleaved starting with
+	// IPv6 as RFC 8305 (Happy Eyeballs) orders them.
+	DualStack AddressFamily = iota
+	// IPv4 returns IPv4 addresses only.
+	IPv4
+	// IPv6 returns IPv6 addresses only.
+	IPv6
+)
+
+// WithAddressFamily sets the address family used by ResolveHost and GetDNS,
+// the default is DualStack. Use IPv4 where IPv6 is configured but not
+// routed.
+func WithAddressFamily(family AddressFamily) Option {
+	return func(c *Client) error {
+		if family < DualStack || family > IPv6 {
+			return ErrInvalidFamily
+		}
+		c.family = family
+		return nil
+	}
+}
+
+// addressTypes returns the query types for the client's address family.
+func (c *Client) addressTypes() []uint16 {
+	switch c.family {
+	case IPv4:
+		return []uint16{dns.TypeA}
+	case IPv6:
+		return []uint16{dns.TypeAAAA}
+	default:
+		return []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+}
+
+// ResolveHost returns the addresses of name, relative to the client's domain,
+// such as the UUID of a service that registered an IP address, in the
+// client's address family. It returns ErrServiceNotFound if there are none.
+func (c *Client) ResolveHost(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := c.ResolveHostTTL(ctx, name)
+	return ips, err
+}
+
+// ResolveHostTTL is like ResolveHost, but also returns how long the
+// addresses may be cached: the lowest TTL of the answer records of both
+// families. The TTL is zero if there are no addresses.
+func (c *Client) ResolveHostTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	var (
+		v4, v6 []net.IP
+		ttl    uint32
+		answer bool
+	)
+	for _, qtype := range c.addressTypes() {
+		resp, err := c.QueryContext(ctx, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(resp.Answer) > 0 {
+			if t := answerTTL(resp.Answer); !answer || t < ttl {
+				ttl = t
+			}
+			answer = true
+		}
+		for _, r := range resp.Answer {
+			switch v := r.(type) {
+			case *dns.A:
+				v4 = append(v4, v.A)
+			case *dns.AAAA:
+				v6 = append(v6, v.AAAA)
+			}
+		}
+	}
+	// Interleave the families, for DualStack, starting with IPv6.
+	ips := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ips = append(ips, v6[i])
+		}
+		if i < len(v4) {
+			ips = append(ips, v4[i])
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, ErrServiceNotFound
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/skynetservices/skydns1/msg"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// serviceFields holds the JSON names of the fields of msg.Service.
+	serviceFields = jsonFields(reflect.TypeOf(msg.Service{}))
+	// ttlField is the JSON name of msg.Service's TTL.
+	ttlField = jsonName(reflect.TypeOf(msg.Service{}), "TTL")
+)
+
+// jsonFields returns the set of JSON field names encoding/json uses for
+// the exported fields of the struct type t.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if name := fieldName(f); name != "" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// jsonName returns the JSON name of the named field of the struct type t.
+func jsonName(t reflect.Type, field string) string {
+	f, ok := t.FieldByName(field)
+	if !ok {
+		panic("client: no field " + field + " in " + t.String())
+	}
+	return fieldName(f)
+}
+
+// fieldName returns the JSON name of f, or "" if it is not encoded.
+func fieldName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	if n := strings.Split(tag, ",")[0]; n != "" {
+		return n
+	}
+	return f.Name
+}
+
+// project zeroes the fields of s whose JSON names are not in keep.
+func project(s *msg.Service, keep map[string]bool) {
+	v := reflect.ValueOf(s).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || keep[fieldName(f)] {
+			continue
+		}
+		v.Field(i).Set(reflect.Zero(f.Type))
+	}
+}
+
+// numericFields holds the JSON names of the numeric fields of msg.Service.
+var numericFields = func() map[string]bool {
+	t := reflect.TypeOf(msg.Service{})
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			if name := fieldName(f); name != "" && f.PkgPath == "" {
+				fields[name] = true
+			}
+		}
+	}
+	return fields
+}()
+
+// lenientNumbers returns the JSON in b with the numeric fields of services
+// that are given as strings, like "TTL": "30", turned into numbers.
+func lenientNumbers(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(unquoteNumbers(v))
+}
+
+// unquoteNumbers replaces, in the decoded JSON v, string values of numeric
+// service fields that hold a number by that number. Only the fields of a
+// service, or of the services in a list, are replaced; nested objects like
+// Metadata are left as they are.
+func unquoteNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		unquoteService(v)
+	case []interface{}:
+		for _, e := range v {
+			if m, ok := e.(map[string]interface{}); ok {
+				unquoteService(m)
+			}
+		}
+	}
+	return v
+}
+
+// unquoteService replaces the string values of the numeric fields of the
+// decoded service m that hold a number by that number.
+func unquoteService(m map[string]interface{}) {
+	for k, e := range m {
+		if s, ok := e.(string); ok && numericFields[k] {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+				m[k] = json.Number(strings.TrimSpace(s))
+			}
+		}
+	}
+}
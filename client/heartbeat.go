@@ -0,0 +1,201 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Heartbeat keeps a service registered by refreshing its TTL at a regular
+// interval. The TTL and interval can be changed while it runs.
+type Heartbeat struct {
+	c    *Client
+	uuid string
+
+	mu        sync.Mutex
+	ttl       uint32
+	effective uint32 // TTL the server applied in the last refresh
+	interval  time.Duration
+	jitter    float64 // fraction of interval to randomly add or subtract
+	err       error   // last error from Update
+
+	// refreshed, if set, is called with the result of every refresh; the
+	// heartbeat ends when it returns false.
+	refreshed func(error) bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Heartbeat starts refreshing the TTL of the service uuid to ttl every
+// interval, the first refresh is done after one interval. Call Stop on the
+// returned Heartbeat to end it. Each interval is randomly lengthened or
+// shortened by the client's heartbeat jitter, see WithHeartbeatJitter.
+//
+// If the longest interval the jitter allows is not shorter than the TTL,
+// the service would expire between refreshes and ErrHeartbeatTooSlow is
+// returned.
+func (c *Client) Heartbeat(uuid string, ttl uint32, interval time.Duration) (*Heartbeat, error) {
+	return c.heartbeat(uuid, ttl, interval, nil)
+}
+
+func (c *Client) heartbeat(uuid string, ttl uint32, interval time.Duration, refreshed func(error) bool) (*Heartbeat, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	if err := checkHeartbeat(ttl, interval, c.jitter); err != nil {
+		return nil, err
+	}
+	h := &Heartbeat{
+		c:         c,
+		uuid:      uuid,
+		ttl:       ttl,
+		interval:  interval,
+		jitter:    c.jitter,
+		refreshed: refreshed,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go h.run()
+	return h, nil
+}
+
+// checkHeartbeat returns an error if refreshing a service to ttl every
+// interval, with jitter, would let it expire between refreshes.
+func checkHeartbeat(ttl uint32, interval time.Duration, jitter float64) error {
+	if ttl == 0 {
+		return ErrInvalidTTL
+	}
+	if longest := time.Duration(float64(interval) * (1 + jitter)); longest >= time.Duration(ttl)*time.Second {
+		return ErrHeartbeatTooSlow
+	}
+	return nil
+}
+
+// SetTTL changes the TTL the service is refreshed to. The service is
+// refreshed with the new TTL right away. A TTL that Heartbeat would reject,
+// zero or not longer than the current interval allows, returns the same
+// error and leaves the TTL unchanged.
+func (h *Heartbeat) SetTTL(ttl uint32) error {
+	h.mu.Lock()
+	if err := checkHeartbeat(ttl, h.interval, h.jitter); err != nil {
+		h.mu.Unlock()
+		return err
+	}
+	h.ttl = ttl
+	h.mu.Unlock()
+	h.poke()
+	return nil
+}
+
+// SetInterval changes the refresh interval. The service is refreshed right
+// away, after which the new interval is used.
+func (h *Heartbeat) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	h.mu.Lock()
+	h.interval = interval
+	h.mu.Unlock()
+	h.poke()
+}
+
+// SetJitter sets the fraction, between 0 and 1, by which each interval is
+// randomly lengthened or shortened.
+func (h *Heartbeat) SetJitter(jitter float64) {
+	if jitter < 0 || jitter > 1 {
+		return
+	}
+	h.mu.Lock()
+	h.jitter = jitter
+	h.mu.Unlock()
+}
+
+// TTL returns the TTL the server applied in the last successful refresh, or
+// zero if there has not been one. This may be different from the requested
+// TTL if the server clamps TTLs.
+func (h *Heartbeat) TTL() uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.effective
+}
+
+// Err returns the error of the last refresh, or nil if it succeeded.
+func (h *Heartbeat) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Stop ends the heartbeat, it does not remove the service. Stop waits for
+// a running refresh to finish.
+func (h *Heartbeat) Stop() {
+	h.once.Do(func() { close(h.stop) })
+	<-h.done
+}
+
+// Done returns a channel that is closed when the heartbeat has ended.
+func (h *Heartbeat) Done() <-chan struct{} {
+	return h.done
+}
+
+// next returns the interval until the next refresh. The lock must be held.
+func (h *Heartbeat) next() time.Duration {
+	if h.jitter == 0 {
+		return h.interval
+	}
+	f := 1 + h.jitter*(2*rand.Float64()-1)
+	return time.Duration(float64(h.interval) * f)
+}
+
+func (h *Heartbeat) poke() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *Heartbeat) run() {
+	defer close(h.done)
+
+	h.mu.Lock()
+	t := time.NewTimer(h.next())
+	h.mu.Unlock()
+	defer t.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-h.wake:
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-t.C:
+		}
+
+		h.mu.Lock()
+		ttl := h.ttl
+		h.mu.Unlock()
+		effective, err := h.c.UpdateEffective(h.uuid, ttl)
+
+		h.mu.Lock()
+		h.err = err
+		if err == nil {
+			h.effective = effective
+		}
+		t.Reset(h.next())
+		h.mu.Unlock()
+
+		if h.refreshed != nil && !h.refreshed(err) {
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"github.com/skynetservices/skydns1/msg"
+	"net/http"
+	"time"
+)
+
+// A ServiceRevision is a past state of a service, as it was from Time on.
+type ServiceRevision struct {
+	Time    time.Time
+	Service *msg.Service
+}
+
+// GetServiceHistory returns the revisions of the service uuid, oldest first,
+// from /skydns/services/<uuid>/history. The SkyDNS server keeps no history;
+// servers without the endpoint, which answer 404, 405 or 501, make it return
+// ErrNotSupported, so a service without history can not be told apart from a
+// missing one.
+func (c *Client) GetServiceHistory(uuid string) ([]ServiceRevision, error) {
+	req, err := c.newRequest("GET", c.joinUrl(uuid)+"/history", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, newHTTPError(resp, ErrNotSupported)
+	default:
+		return nil, newHTTPError(resp, ErrInvalidResponse)
+	}
+
+	if err := checkContentType(resp); err != nil {
+		return nil, err
+	}
+	var out []ServiceRevision
+	if err := c.decode(resp.Body, &out); err != nil {
+		return nil, err
+	}
+	if out == nil {
+		out = []ServiceRevision{}
+	}
+	return out, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// leaderState tracks the base URL of the raft leader, it is shared between
+// copies of a Client.
+type leaderState struct {
+	sync.Mutex
+	base string
+}
+
+// Leader returns the HTTP address (host:port) of the current leader of the
+// SkyDNS cluster. The leader's IP address is looked up as leader.<domain>
+// over DNS, its port is assumed to be the port of the client's HTTP address.
+func (c *Client) Leader() (string, error) {
+	u, err := url.Parse(c.base)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	req, err := c.newRequestDNS("leader", dns.TypeA)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.exchange(context.Background(), req)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range resp.Answer {
+		if a, ok := r.(*dns.A); ok {
+			return net.JoinHostPort(a.A.String(), port), nil
+		}
+	}
+	return "", ErrNoLeader
+}
+
+// isWrite reports whether method changes state on the server.
+func isWrite(method string) bool {
+	return method == "PUT" || method == "PATCH" || method == "DELETE" || method == "POST"
+}
+
+// leaderMoved reports whether the status code signals that the request
+// should have been sent to another (the leader) node.
+func leaderMoved(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect, http.StatusMisdirectedRequest:
+		return true
+	}
+	return false
+}
+
+// doLeader sends a mutating request to the leader. If the server reports
+// that leadership moved, the leader is refreshed and the request is resent
+// once.
+func (c *Client) doLeader(req *http.Request) (*http.Response, error) {
+	c.leader.Lock()
+	base := c.leader.base
+	c.leader.Unlock()
+	if base == "" {
+		base = c.base
+		if addr, err := c.Leader(); err == nil {
+			base = c.schemeOf() + "://" + addr
+		}
+	}
+	if err := retarget(req, base); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(req)
+	if err != nil || !leaderMoved(resp.StatusCode) {
+		if err == nil {
+			c.setLeader(base)
+		}
+		return resp, err
+	}
+
+	// Leadership changed, prefer the redirect target over a new lookup.
+	base, err = c.extractBaseFromLocation(resp.Header.Get("Location"))
+	if err != nil {
+		addr, lerr := c.Leader()
+		if lerr != nil {
+			return resp, nil
+		}
+		base = c.schemeOf() + "://" + addr
+	}
+	if req.GetBody == nil && req.Body != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	if err := retarget(retry, base); err != nil {
+		return nil, err
+	}
+	resp, err = c.send(retry)
+	if err == nil && !leaderMoved(resp.StatusCode) {
+		c.setLeader(base)
+	}
+	return resp, err
+}
+
+func (c *Client) setLeader(base string) {
+	c.leader.Lock()
+	c.leader.base = base
+	c.leader.Unlock()
+}
+
+// schemeOf returns the scheme of the client's HTTP address.
+func (c *Client) schemeOf() string {
+	if u, err := url.Parse(c.base); err == nil && u.Scheme != "" {
+		return u.Scheme
+	}
+	return "http"
+}
+
+// retarget points req at the host in base.
+func retarget(req *http.Request, base string) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	req.Host = u.Host
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/skynetservices/skydns1/msg"
+	"sync"
+	"time"
+)
+
+// A Lease is a service registration that is kept alive until it is released.
+type Lease struct {
+	c    *Client
+	uuid string
+	h    *Heartbeat
+
+	mu     sync.Mutex
+	lastOK time.Time
+	err    error
+
+	done chan struct{}
+	once sync.Once
+}
+
+// Acquire adds the service s under uuid with ttl and keeps refreshing it,
+// three times per TTL, until Release is called. ctx bounds the registration
+// only. If the lease can not be renewed anymore, because the service is gone
+// from the server or no refresh succeeded for a whole TTL, Done is closed
+// and Err returns the reason.
+func (c *Client) Acquire(ctx context.Context, uuid string, s *msg.Service, ttl uint32) (*Lease, error) {
+	if ttl == 0 {
+		return nil, ErrInvalidTTL
+	}
+	n := *s
+	n.TTL = ttl
+	if err := c.AddContext(ctx, uuid, &n); err != nil {
+		return nil, err
+	}
+	l := &Lease{c: c, uuid: uuid, lastOK: time.Now(), done: make(chan struct{})}
+	interval := time.Duration(ttl) * time.Second / 3
+	h, err := c.heartbeat(uuid, ttl, interval, func(err error) bool {
+		return l.refreshed(err, ttl)
+	})
+	if err != nil {
+		c.DeleteContext(ctx, uuid)
+		return nil, err
+	}
+	l.h = h
+	return l, nil
+}
+
+// refreshed records the result of a refresh and reports whether the lease
+// is still alive.
+func (l *Lease) refreshed(err error, ttl uint32) bool {
+	l.mu.Lock()
+	if err == nil {
+		l.lastOK = time.Now()
+		l.mu.Unlock()
+		return true
+	}
+	expired := time.Since(l.lastOK) >= time.Duration(ttl)*time.Second
+	if !errors.Is(err, ErrServiceNotFound) && !expired {
+		l.mu.Unlock()
+		return true
+	}
+	l.err = err
+	l.mu.Unlock()
+	l.once.Do(func() { close(l.done) })
+	return false
+}
+
+// Release stops renewing the lease and deletes the service. A service that
+// is already gone is not an error.
+func (l *Lease) Release() error {
+	l.h.Stop()
+	l.once.Do(func() { close(l.done) })
+	err := l.c.Delete(l.uuid)
+	if errors.Is(err, ErrServiceNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Done returns a channel that is closed when the lease ends, either because
+// it was released or because it could not be renewed.
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err returns why the lease could not be renewed, or nil.
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
@@ -0,0 +1,561 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/skynetservices/skydns1/msg"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nextCursorHeader is the response header a server uses to hand out the
+// cursor of the next page of services.
+const nextCursorHeader = "X-Next-Cursor"
+
+// openList sends req, a GET of a list of services, and returns the response
+// if its status is 200 OK with a JSON body, 404 Not Found, the server's
+// answer when there are no services, or 304 Not Modified to a conditional
+// request. Other statuses are returned as an *HTTPError. The caller closes
+// the body.
+func (c *Client) openList(req *http.Request) (*http.Response, error) {
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		err = checkContentType(resp)
+	case resp.StatusCode == http.StatusNotFound:
+	case resp.StatusCode == http.StatusNotModified && req.Header.Get("If-None-Match") != "":
+	default:
+		err = newHTTPError(resp, ErrInvalidResponse)
+	}
+	if err != nil {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// list fetches the services with req, as by openList, and returns them with
+// the response for its headers; its body is closed. The services are empty
+// for a 404 and nil for a 304.
+func (c *Client) list(req *http.Request) ([]*msg.Service, *http.Response, error) {
+	resp, err := c.openList(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, resp, nil
+	case http.StatusNotFound:
+		return nonNilServices(nil), resp, nil
+	}
+	var out []*msg.Service
+	if err := c.decode(resp.Body, &out); err != nil {
+		return nil, nil, err
+	}
+	return nonNilServices(out), resp, nil
+}
+
+// GetServicesAfter returns at most limit services following cursor, and the
+// cursor of the next page. An empty cursor starts at the beginning, an empty
+// next cursor means there are no more pages. A limit of zero or less leaves
+// the page size to the server. Servers that do not support cursors return all
+// services in a single page.
+func (c *Client) GetServicesAfter(cursor string, limit int) ([]*msg.Service, string, error) {
+	v := url.Values{}
+	if cursor != "" {
+		v.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	u := c.joinUrl("")
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+	req, err := c.newRequest("GET", u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	out, resp, err := c.list(req)
+	if err != nil {
+		return nil, "", err
+	}
+	next := resp.Header.Get(nextCursorHeader)
+	if next == cursor {
+		// A server that ignores the cursor must not make us loop.
+		next = ""
+	}
+	return out, next, nil
+}
+
+// GetServicesModifiedSince returns the services registered or refreshed
+// after t, passing t to the server as the since parameter in RFC 3339 form.
+// The SkyDNS server does not track modification times and ignores the
+// parameter, in which case all services are returned; callers must treat
+// the result as a superset of the changes.
+func (c *Client) GetServicesModifiedSince(t time.Time) ([]*msg.Service, error) {
+	return c.GetServicesModifiedSinceContext(context.Background(), t)
+}
+
+// GetServicesModifiedSinceContext is like GetServicesModifiedSince, but the
+// request is bound to ctx.
+func (c *Client) GetServicesModifiedSinceContext(ctx context.Context, t time.Time) ([]*msg.Service, error) {
+	v := url.Values{}
+	v.Set("since", t.UTC().Format(time.RFC3339Nano))
+	return c.getAll(ctx, c.joinUrl("")+"?"+v.Encode())
+}
+
+// GetServicesProjected returns all services with only the fields named in
+// fields, by their JSON names such as Host and Port, set; the other fields
+// are zero. The fields are sent to the server as the fields parameter, so a
+// server supporting it can leave the others out. The SkyDNS server ignores
+// it and sends full services, which are projected here. An unknown field
+// returns ErrUnknownField.
+func (c *Client) GetServicesProjected(fields []string) ([]*msg.Service, error) {
+	if len(fields) == 0 {
+		return nil, ErrNoFields
+	}
+	keep := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if !serviceFields[f] {
+			return nil, ErrUnknownField
+		}
+		keep[f] = true
+	}
+	v := url.Values{}
+	v.Set("fields", strings.Join(fields, ","))
+	out, err := c.getAll(context.Background(), c.joinUrl("")+"?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range out {
+		if s != nil {
+			project(s, keep)
+		}
+	}
+	return out, nil
+}
+
+// WalkServices calls fn for every service, fetching pages of at most limit
+// services with GetServicesAfter until the cursors are exhausted. If fn
+// returns an error the walk stops and that error is returned.
+func (c *Client) WalkServices(limit int, fn func(*msg.Service) error) error {
+	cursor := ""
+	for {
+		services, next, err := c.GetServicesAfter(cursor, limit)
+		if err != nil {
+			return err
+		}
+		for _, s := range services {
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// StreamAllServices fetches all services and calls fn for each as it is
+// decoded, without holding the whole list in memory. If fn returns an error
+// the stream stops and that error is returned. A response that ends before
+// the closing bracket of the list, e.g. because the server went away, is
+// reported as ErrDecode wrapping io.ErrUnexpectedEOF, after fn was called for
+// the services received so far; callers must not treat those as complete.
+func (c *Client) StreamAllServices(ctx context.Context, fn func(*msg.Service) error) error {
+	req, err := c.newRequestContext(ctx, "GET", c.joinUrl(""), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.openList(req)
+	if err != nil {
+		return err
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	r := bufio.NewReader(resp.Body)
+	if b, _ := r.Peek(len(utf8BOM)); bytes.Equal(b, utf8BOM) {
+		r.Discard(len(utf8BOM))
+	}
+	cr := &countReader{r: r}
+	d := json.NewDecoder(cr)
+	if c.strict {
+		d.DisallowUnknownFields()
+	}
+	tok, err := d.Token()
+	if err != nil {
+		return cr.decodeError(err)
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("%w: expected a list, got %v", ErrDecode, tok)
+	}
+	for d.More() {
+		var s msg.Service
+		if c.lenient {
+			var raw json.RawMessage
+			if err := d.Decode(&raw); err != nil {
+				return cr.decodeError(err)
+			}
+			if err := c.decode(bytes.NewReader(raw), &s); err != nil {
+				return err
+			}
+		} else if err := d.Decode(&s); err != nil {
+			return cr.decodeError(err)
+		}
+		if err := fn(&s); err != nil {
+			return err
+		}
+	}
+	if _, err := d.Token(); err != nil {
+		return cr.decodeError(err)
+	}
+	return nil
+}
+
+// A countReader counts the bytes read and whether the end was reached, so a
+// decoding error can be told apart from a truncated input.
+type countReader struct {
+	r   io.Reader
+	n   int64
+	eof bool
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// decodeError turns an error of a decoder reading from r into an ErrDecode.
+// The input ending where more JSON is due is an io.ErrUnexpectedEOF; the
+// decoder reports that as a syntax error at the end of the input.
+func (r *countReader) decodeError(err error) error {
+	var (
+		serr *json.SyntaxError
+		terr *json.UnmarshalTypeError
+	)
+	switch {
+	case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &serr) && r.eof && serr.Offset >= r.n:
+		return fmt.Errorf("%w: %w", ErrDecode, io.ErrUnexpectedEOF)
+	case serr != nil, errors.As(err, &terr):
+		return fmt.Errorf("%w: %s", ErrDecode, err)
+	default:
+		return err
+	}
+}
+
+// GetAllServicesIfChanged fetches all services unless they are unchanged
+// since the response that carried etag. If the server answers 304 Not
+// Modified, changed is false and services is nil. The returned etag is
+// passed to the next call; it is empty if the server does not send ETags,
+// in which case every call fetches the full list.
+func (c *Client) GetAllServicesIfChanged(etag string) (services []*msg.Service, newEtag string, changed bool, err error) {
+	req, err := c.newRequest("GET", c.joinUrl(""), nil)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	services, resp, err := c.list(req)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, false, nil
+	}
+	return services, resp.Header.Get("ETag"), true, nil
+}
+
+// CountServices returns the number of registered services. The SkyDNS server
+// has no count endpoint, so the counts of GetRegions, which cover every
+// service once, are summed; the services themselves are not fetched.
+func (c *Client) CountServices() (int, error) {
+	regions, err := c.GetRegions()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, count := range regions {
+		n += count
+	}
+	return n, nil
+}
+
+// GetServicesByTag returns the services whose metadata has key set to value.
+// The SkyDNS server can not filter on metadata, so all services are fetched
+// and filtered by the client. If no service matches an empty slice is
+// returned.
+func (c *Client) GetServicesByTag(key, value string) ([]*msg.Service, error) {
+	services, err := c.GetAllServices()
+	if err != nil {
+		return nil, err
+	}
+	return filterServices(services, func(s *msg.Service) bool {
+		v, ok := s.Metadata[key]
+		return ok && v == value
+	}), nil
+}
+
+// GetRegionServices returns the services registered in region. The server
+// selects them with the query region.*.*.*; the result is filtered here as
+// well, so a server that ignores the query, or matches the region without
+// regard to case, returns only the services in region. Use GetRegions for
+// the counts only.
+func (c *Client) GetRegionServices(region string) ([]*msg.Service, error) {
+	services, err := c.getQuery(queryLabel(region) + ".*.*.*")
+	if err != nil {
+		return nil, err
+	}
+	return filterServices(services, func(s *msg.Service) bool {
+		return s.Region == region
+	}), nil
+}
+
+// GetServicesScoped returns the services in region and environment, either of
+// which may be empty to match any. The server selects them with the query
+// region.*.*.environment and the result is filtered here as well, as by
+// GetRegionServices. The result is never nil.
+func (c *Client) GetServicesScoped(region, environment string) ([]*msg.Service, error) {
+	services, err := c.getQuery(queryLabel(region) + ".*.*." + queryLabel(environment))
+	if err != nil {
+		return nil, err
+	}
+	return filterServices(services, func(s *msg.Service) bool {
+		return (region == "" || s.Region == region) &&
+			(environment == "" || s.Environment == environment)
+	}), nil
+}
+
+// getQuery fetches the services matching the server's query q, whose labels
+// are matched against the region, version, name and environment of a
+// service, "*" matching any.
+func (c *Client) getQuery(q string) ([]*msg.Service, error) {
+	v := url.Values{}
+	v.Set("query", q)
+	return c.getAll(context.Background(), c.joinUrl("")+"?"+v.Encode())
+}
+
+// queryLabel returns s as a label of a server query. A value the server
+// cannot match, as it is empty or holds a dot or a wildcard, matches any and
+// is left to the filter on the result.
+func queryLabel(s string) string {
+	if s == "" || strings.ContainsAny(s, ".*") {
+		return "*"
+	}
+	return s
+}
+
+// GetServicesByEnvironments returns all services grouped by their
+// environment, fetched in a single request. The server's environment counts
+// are derived from the same list, so no environment without services is
+// left out.
+func (c *Client) GetServicesByEnvironments() (map[string][]*msg.Service, error) {
+	services, err := c.GetAllServices()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]*msg.Service)
+	for _, s := range services {
+		if s != nil {
+			m[s.Environment] = append(m[s.Environment], s)
+		}
+	}
+	return m, nil
+}
+
+// nonNilServices returns services, or an empty slice if it is nil, as a JSON
+// null decodes to a nil slice.
+func nonNilServices(services []*msg.Service) []*msg.Service {
+	if services == nil {
+		return []*msg.Service{}
+	}
+	return services
+}
+
+// filterServices returns the services for which keep returns true. The
+// result is never nil.
+func filterServices(services []*msg.Service, keep func(*msg.Service) bool) []*msg.Service {
+	out := make([]*msg.Service, 0)
+	for _, s := range services {
+		if s != nil && keep(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// withoutNil returns services without the nil entries a null in the
+// server's list decodes to.
+func withoutNil(services []*msg.Service) []*msg.Service {
+	return filterServices(services, func(*msg.Service) bool { return true })
+}
+
+// GetAllServicesSorted is like GetAllServices, but the services are sorted by
+// UUID, and by Host and Port for services without one. Null entries in the
+// server's list are left out.
+func (c *Client) GetAllServicesSorted() ([]*msg.Service, error) {
+	services, err := c.GetAllServices()
+	if err != nil {
+		return nil, err
+	}
+	services = withoutNil(services)
+	sortServices(services)
+	return services, nil
+}
+
+// sortedByHeader is the response header a server that sorted and paged the
+// services for GetServicesSorted sets to the field it sorted by.
+const sortedByHeader = "X-Sorted-By"
+
+// serviceLess holds, by JSON name, the fields GetServicesSorted can sort by.
+var serviceLess = map[string]func(a, b *msg.Service) bool{
+	"UUID":        func(a, b *msg.Service) bool { return a.UUID < b.UUID },
+	"Name":        func(a, b *msg.Service) bool { return a.Name < b.Name },
+	"Version":     func(a, b *msg.Service) bool { return a.Version < b.Version },
+	"Environment": func(a, b *msg.Service) bool { return a.Environment < b.Environment },
+	"Region":      func(a, b *msg.Service) bool { return a.Region < b.Region },
+	"Host":        func(a, b *msg.Service) bool { return a.Host < b.Host },
+	"Port":        func(a, b *msg.Service) bool { return a.Port < b.Port },
+	"TTL":         func(a, b *msg.Service) bool { return a.TTL < b.TTL },
+	"Expires":     func(a, b *msg.Service) bool { return a.Expires.Before(b.Expires) },
+}
+
+// GetServicesSorted returns at most limit services, skipping the first
+// offset, sorted by the field named by, such as Host or TTL, in descending
+// order if desc is set; services that are equal in it are in the order of
+// GetAllServicesSorted. A limit of zero or less returns all services after
+// offset. The parameters are sent to the server as sort, order, offset and
+// limit; a server that applied them says so with an X-Sorted-By header. The
+// SkyDNS server cannot sort, so all services are fetched and sorted and
+// paged here. An unknown field returns ErrUnknownField.
+func (c *Client) GetServicesSorted(by string, desc bool, offset, limit int) ([]*msg.Service, error) {
+	less, ok := serviceLess[by]
+	if !ok {
+		return nil, ErrUnknownField
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	order := "asc"
+	if desc {
+		order = "desc"
+	}
+	v := url.Values{}
+	v.Set("sort", by)
+	v.Set("order", order)
+	v.Set("offset", strconv.Itoa(offset))
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	req, err := c.newRequest("GET", c.joinUrl("")+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	out, resp, err := c.list(req)
+	if err != nil {
+		return nil, err
+	}
+	// Null entries cannot be compared, leave them out.
+	out = withoutNil(out)
+	if resp.Header.Get(sortedByHeader) == by {
+		return out, nil
+	}
+
+	sortServices(out)
+	sort.SliceStable(out, func(i, j int) bool {
+		if desc {
+			return less(out[j], out[i])
+		}
+		return less(out[i], out[j])
+	})
+	if offset > len(out) {
+		offset = len(out)
+	}
+	out = out[offset:]
+	if limit > 0 && limit < len(out) {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// sortServices sorts services, which must not hold nil, by UUID, Host and
+// Port.
+func sortServices(services []*msg.Service) {
+	sort.SliceStable(services, func(i, j int) bool {
+		a, b := services[i], services[j]
+		if a.UUID != b.UUID {
+			return a.UUID < b.UUID
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Port < b.Port
+	})
+}
+
+// GetAllServicesMap returns all services keyed as by ServiceMap.
+func (c *Client) GetAllServicesMap() (map[string]*msg.Service, error) {
+	services, err := c.GetAllServices()
+	if err != nil {
+		return nil, err
+	}
+	return c.ServiceMap(services), nil
+}
+
+// ServiceMap returns services keyed by the client's key function, by default
+// their UUID, for use with DiffServices. Services without a key are left out
+// of the map.
+func (c *Client) ServiceMap(services []*msg.Service) map[string]*msg.Service {
+	m := make(map[string]*msg.Service, len(services))
+	for _, s := range services {
+		if s == nil {
+			continue
+		}
+		if k := c.key(s); k != "" {
+			m[k] = s
+		}
+	}
+	return m
+}
+
+// serviceUUID is the default key function. The SkyDNS server always includes
+// the UUID a service was registered under.
+func serviceUUID(s *msg.Service) string {
+	return s.UUID
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"time"
+)
+
+// An Observer is told about every HTTP request the client sends. Status is
+// zero when the request failed without a response, in which case err is set.
+// ObserveRequest is called from the goroutine doing the request, it must be
+// safe for concurrent use.
+type Observer interface {
+	ObserveRequest(method, path string, status int, d time.Duration, err error)
+}
+
+// WithObserver registers an Observer with the client.
+func WithObserver(o Observer) Option {
+	return func(c *Client) error {
+		c.observer = o
+		return nil
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// An Option configures a Client. Options are given to NewClient.
+type Option func(*Client) error
+
+// A RequestOption changes a single request, methods that accept them say so.
+type RequestOption func(*http.Request)
+
+// WithHeader sets the header key to value on a request.
+func WithHeader(key, value string) RequestOption {
+	return func(req *http.Request) {
+		req.Header.Set(key, value)
+	}
+}
+
+// WithAccept sets the media type the client asks for in the Accept header of
+// its HTTP requests, application/json by default, for servers that negotiate
+// the format of their responses. Responses are decoded as JSON, so the media
+// type must be a JSON one, application/json or a +json type such as
+// application/vnd.skydns+json; anything else returns ErrInvalidMediaType.
+func WithAccept(mediaType string) Option {
+	return func(c *Client) error {
+		mt, _, err := mime.ParseMediaType(mediaType)
+		if err != nil || (mt != "application/json" && !strings.HasSuffix(mt, "+json")) {
+			return ErrInvalidMediaType
+		}
+		c.accept = mediaType
+		return nil
+	}
+}
+
+// WithHeaders sets the headers in h on every HTTP request of the client, such
+// as the Origin or custom headers a server's CORS policy requires. Headers
+// the client sets itself, like Content-Type for JSON bodies, take precedence;
+// an Authorization header takes the place of the client's secret. Browsers
+// send CORS preflight requests on their own, the client does not.
+func WithHeaders(h http.Header) Option {
+	return func(c *Client) error {
+		c.headers = h.Clone()
+		return nil
+	}
+}
+
+// WithRequestCompression enables gzip compression of large request bodies
+// in Add and AddCallback. Only enable this when the server is known to
+// accept a Content-Encoding of gzip.
+func WithRequestCompression(compress bool) Option {
+	return func(c *Client) error {
+		c.compress = compress
+		return nil
+	}
+}
+
+// WithContext makes ctx the parent of every call of the client, so the calls
+// in flight are cancelled when ctx is, composing with the context passed to
+// a call. Once ctx is cancelled every further call fails with its error,
+// the client is then of no more use.
+func WithContext(ctx context.Context) Option {
+	return func(c *Client) error {
+		c.ctx = ctx
+		return nil
+	}
+}
+
+// WithCallbackCheck makes AddCallback connect to the reply address of a
+// callback before registering it, and fail with ErrInvalidCallback if it
+// cannot, as the server does not report callbacks it fails to reach. The
+// check is only meaningful when the client runs where the server can reach
+// the same address.
+func WithCallbackCheck(check bool) Option {
+	return func(c *Client) error {
+		c.checkCallback = check
+		return nil
+	}
+}
+
+// WithStreamingAdd makes Add encode the service straight into the request
+// body instead of buffering it first, which lowers peak memory for services
+// with large payloads. The body cannot be sent again, so such an Add is not
+// retried when its connection is reset nor resent to a new raft leader. With
+// WithRequestCompression every streamed body is compressed, as its size is
+// not known up front.
+func WithStreamingAdd(stream bool) Option {
+	return func(c *Client) error {
+		c.streamAdd = stream
+		return nil
+	}
+}
+
+// WithDNSDialer sets the dialer used for DNS queries, e.g. to pin the local
+// address queries are sent from or to bound the dial time. The local address,
+// if set, must be a *net.UDPAddr as DNS queries are sent over UDP.
+func WithDNSDialer(d *net.Dialer) Option {
+	return func(c *Client) error {
+		if d == nil {
+			return ErrInvalidDialer
+		}
+		if d.LocalAddr != nil {
+			if _, ok := d.LocalAddr.(*net.UDPAddr); !ok {
+				return ErrInvalidDialer
+			}
+		}
+		c.d.Dialer = d
+		return nil
+	}
+}
+
+// WithEDNSClientSubnet attaches an EDNS Client Subnet option for ipnet to
+// every DNS query, so servers that select records by location answer as if
+// the client were in that subnet. The address is masked to the prefix.
+func WithEDNSClientSubnet(ipnet *net.IPNet) Option {
+	return func(c *Client) error {
+		if ipnet == nil {
+			return ErrInvalidSubnet
+		}
+		ones, bits := ipnet.Mask.Size()
+		e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(ones)}
+		switch {
+		case bits == 32 && ipnet.IP.To4() != nil:
+			e.Family = 1
+			e.Address = ipnet.IP.To4().Mask(ipnet.Mask)
+		case bits == 128 && ipnet.IP.To4() == nil && ipnet.IP.To16() != nil:
+			e.Family = 2
+			e.Address = ipnet.IP.To16().Mask(ipnet.Mask)
+		default:
+			return ErrInvalidSubnet
+		}
+		c.ecs = e
+		return nil
+	}
+}
+
+// WithRawDomain makes the client use the domain given to NewClient, and to
+// ForDomain, verbatim: it is not made fully qualified, and names relative to
+// it are joined to it without a dot, so a query for web is sent for
+// web+domain. The resulting names must still be fully qualified, ending in a
+// dot, for the query to be sent; other queries fail with the error of the
+// dns package.
+func WithRawDomain(raw bool) Option {
+	return func(c *Client) error {
+		c.rawDomain = raw
+		return nil
+	}
+}
+
+// WithDNSOverTCP makes the client send all DNS queries over TCP, for networks
+// that do not pass DNS over UDP. QueryBatch then sends its queries over a
+// single connection.
+func WithDNSOverTCP(tcp bool) Option {
+	return func(c *Client) error {
+		c.dnsTCP = tcp
+		return nil
+	}
+}
+
+// WithIdempotencyKeys makes Add send an Idempotency-Key header, so a server
+// that supports it can recognize a retried Add and apply it once. The key is
+// derived from the UUID and the token set with WithIdempotencyToken, or the
+// service itself if there is none, so it is the same on every retry and on
+// redirects. The SkyDNS server ignores the header.
+func WithIdempotencyKeys(enable bool) Option {
+	return func(c *Client) error {
+		c.idempotencyKeys = enable
+		return nil
+	}
+}
+
+// WithConflictCheck makes Add fetch the existing service when the server
+// reports a conflicting UUID. If that service is the same as the one being
+// added, Add succeeds, otherwise it returns ErrConflictingUUID. This costs an
+// extra round trip on conflicts.
+func WithConflictCheck(check bool) Option {
+	return func(c *Client) error {
+		c.checkConflict = check
+		return nil
+	}
+}
+
+// WithForceOnConflict makes Add overwrite a different service registered
+// under the same UUID: on a conflict the existing service is fetched and, if
+// it differs, deleted, and the new one is added again. Identical services
+// are left alone, as with WithConflictCheck. This is last-writer-wins and
+// racy: between the delete and the re-add the UUID is unregistered, so DNS
+// lookups may miss it, and another writer may register it first, making the
+// re-add fail with ErrConflictingUUID. Use AddWithOverwrite to learn whether
+// a service was overwritten.
+func WithForceOnConflict(force bool) Option {
+	return func(c *Client) error {
+		c.forceConflict = force
+		return nil
+	}
+}
+
+// WithDeleteIdempotent makes Delete succeed when the service is already gone,
+// instead of returning ErrServiceNotFound.
+func WithDeleteIdempotent(idempotent bool) Option {
+	return func(c *Client) error {
+		c.deleteIdempotent = idempotent
+		return nil
+	}
+}
+
+// WithFollowLeader sends Add, Delete, Update and PatchService directly to the
+// raft leader, see Leader. When the server redirects a request or otherwise
+// signals leadership moved, the new leader is used from then on.
+func WithFollowLeader(follow bool) Option {
+	return func(c *Client) error {
+		c.followLeader = follow
+		return nil
+	}
+}
+
+// WithCrossHostRedirects allows the client to follow redirects to another
+// host. By default such redirects are returned as ErrCrossHostRedirect.
+func WithCrossHostRedirects(allow bool) Option {
+	return func(c *Client) error {
+		c.crossHostRedirects = allow
+		return nil
+	}
+}
+
+// WithRequireAuth makes NewClient return ErrNoSecret when no secret is given,
+// instead of sending unauthenticated requests.
+func WithRequireAuth(require bool) Option {
+	return func(c *Client) error {
+		c.requireAuth = require
+		return nil
+	}
+}
+
+// WithWarmup makes NewClient call Warmup, bounded to 5 seconds. A failed
+// warmup is logged and the client is returned anyway, unless WithRequireAuth
+// is set too, then NewClient returns the error.
+func WithWarmup(warmup bool) Option {
+	return func(c *Client) error {
+		c.warmup = warmup
+		return nil
+	}
+}
+
+// WithStrictDecoding makes decoding a response fail when it contains fields
+// that msg.Service does not know, to catch schema drift between client and
+// server.
+func WithStrictDecoding(strict bool) Option {
+	return func(c *Client) error {
+		c.strict = strict
+		return nil
+	}
+}
+
+// WithLenientNumbers makes decoding a response accept the numeric fields of
+// services, like TTL and Port, given as strings holding a number, as some
+// SkyDNS forks send them.
+func WithLenientNumbers(lenient bool) Option {
+	return func(c *Client) error {
+		c.lenient = lenient
+		return nil
+	}
+}
+
+// WithRateLimit limits the client to r HTTP requests per second with bursts
+// of at most burst requests. Requests wait for their turn, or until their
+// context is done.
+func WithRateLimit(r rate.Limit, burst int) Option {
+	return func(c *Client) error {
+		if r <= 0 || (burst < 1 && r != rate.Inf) {
+			return ErrInvalidRateLimit
+		}
+		c.limiter = rate.NewLimiter(r, burst)
+		return nil
+	}
+}
+
+// WithCallbacksPath sets the path under which the server serves callbacks,
+// the default is /skydns/callbacks/. The path must be absolute.
+func WithCallbacksPath(path string) Option {
+	return func(c *Client) error {
+		if !strings.HasPrefix(path, "/") {
+			return ErrInvalidPath
+		}
+		if !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+		c.callbacksPath = path
+		return nil
+	}
+}
+
+// WithHeartbeatJitter sets the fraction, between 0 and 1, by which the
+// intervals of heartbeats started by the client are randomly lengthened or
+// shortened, so many services started together do not refresh all at once.
+// The default is 0.1, zero disables the jitter.
+func WithHeartbeatJitter(jitter float64) Option {
+	return func(c *Client) error {
+		if jitter < 0 || jitter > 1 {
+			return ErrInvalidJitter
+		}
+		c.jitter = jitter
+		return nil
+	}
+}
+
+// WithDNSSingleflight makes concurrent identical DNS queries, same name, type
+// and class, share a single exchange with the server and its reply. This
+// cuts the load when many goroutines look up the same hot service at once.
+func WithDNSSingleflight(enable bool) Option {
+	return func(c *Client) error {
+		c.dnsFlight = nil
+		if enable {
+			c.dnsFlight = &singleflight.Group{}
+		}
+		return nil
+	}
+}
+
+// WithSingleflight makes concurrent calls of Get for the same UUID, and of
+// GetAllServices, share a single request and its result. Only calls sending
+// the same headers, including the Authorization, are shared. Each caller gets
+// its own copy of the services.
+func WithSingleflight(enable bool) Option {
+	return func(c *Client) error {
+		c.httpFlight = nil
+		if enable {
+			c.httpFlight = &singleflight.Group{}
+		}
+		return nil
+	}
+}
+
+// WithMaxConcurrency bounds the HTTP requests the client, and all copies of
+// it, have awaiting a response at any time to n. Further requests wait for a
+// slot, or until their context is done. Bulk methods that take their own
+// concurrency, like ImportContext, are capped by it.
+func WithMaxConcurrency(n int) Option {
+	return func(c *Client) error {
+		if n < 1 {
+			return ErrInvalidLimit
+		}
+		c.sem = make(chan struct{}, n)
+		return nil
+	}
+}
+
+// WithKeyFunc sets how the client derives the key of a service, as used by
+// ServiceMap, GetAllServicesMap and Watch, and as the UUID in the paths of
+// the requests DeleteWhere and Reconcile make for the services they fetch.
+// The default is the UUID the server includes in each service; forks that
+// leave it out can key services by other fields. Services with an empty key
+// are skipped.
+func WithKeyFunc(key func(*msg.Service) string) Option {
+	return func(c *Client) error {
+		if key == nil {
+			return ErrInvalidKeyFunc
+		}
+		c.key = key
+		return nil
+	}
+}
+
+// WithDNSRetries makes the client retry DNS queries that time out or are
+// answered with SERVFAIL up to n times. Definitive answers, like NXDOMAIN,
+// are returned right away.
+func WithDNSRetries(n int) Option {
+	return func(c *Client) error {
+		if n < 0 {
+			return ErrInvalidRetries
+		}
+		c.dnsRetries = n
+		return nil
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package promobserver provides a client.Observer that exports request
+// counts and latencies to Prometheus. It lives in its own package so the
+// client does not depend on the Prometheus libraries.
+package promobserver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skynetservices/skydns1/client"
+	"strconv"
+	"time"
+)
+
+type observer struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// NewPrometheusObserver returns an Observer that records the requests of a
+// client as skydns_client_requests_total and
+// skydns_client_request_duration_seconds, both labeled by method and status.
+// Failed requests have a status of "error". If the metrics are already
+// registered with registerer, the registered ones are used.
+func NewPrometheusObserver(registerer prometheus.Registerer) client.Observer {
+	o := &observer{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "skydns",
+			Subsystem: "client",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests sent to SkyDNS.",
+		}, []string{"method", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "skydns",
+			Subsystem: "client",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of HTTP requests sent to SkyDNS.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "status"}),
+	}
+	if err := registerer.Register(o.requests); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			o.requests = are.ExistingCollector.(*prometheus.CounterVec)
+		}
+	}
+	if err := registerer.Register(o.latency); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			o.latency = are.ExistingCollector.(*prometheus.HistogramVec)
+		}
+	}
+	return o
+}
+
+func (o *observer) ObserveRequest(method, path string, status int, d time.Duration, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(status)
+	}
+	o.requests.WithLabelValues(method, code).Inc()
+	o.latency.WithLabelValues(method, code).Observe(d.Seconds())
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package promobserver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/skynetservices/skydns1/client"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrometheusObserver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+
+	reg := prometheus.NewRegistry()
+	o := NewPrometheusObserver(reg)
+	c, err := client.NewClient(ts.URL, "", "skydns.local", "127.0.0.1:1", client.WithObserver(o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetAllServices(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := o.(*observer).requests
+	if n := testutil.ToFloat64(requests.WithLabelValues("GET", "200")); n != 1 {
+		t.Fatalf("Expected 1 GET with status 200, got %v", n)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count uint64
+	for _, f := range families {
+		if f.GetName() == "skydns_client_request_duration_seconds" {
+			for _, m := range f.GetMetric() {
+				count += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	if count != 1 {
+		t.Fatalf("Expected 1 observed latency, got %d", count)
+	}
+
+	// A second observer on the same registry shares the metrics.
+	again := NewPrometheusObserver(reg)
+	again.ObserveRequest("GET", "/skydns/services/", 0, 0, http.ErrHandlerTimeout)
+	if n := testutil.ToFloat64(requests.WithLabelValues("GET", "error")); n != 1 {
+		t.Fatalf("Expected 1 failed GET on the shared counter, got %v", n)
+	}
+}
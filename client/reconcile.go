@@ -0,0 +1,161 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/skynetservices/skydns1/msg"
+	"sync"
+)
+
+// ReconcileOptions are the options of Reconcile.
+type ReconcileOptions struct {
+	// Prune deletes the registered services that are not desired. Without
+	// it Reconcile only adds and updates.
+	Prune bool
+
+	// Concurrency is the number of requests made at a time, at least 1.
+	Concurrency int
+}
+
+// A ReconcileResult reports what Reconcile did.
+type ReconcileResult struct {
+	Added, Updated, Deleted int
+
+	// Errors holds the errors of the services that could not be added,
+	// updated or deleted, by UUID. It is empty if all changes were made.
+	Errors map[string]error
+}
+
+// reconcileOp is a change Reconcile makes to the service uuid.
+type reconcileOp struct {
+	uuid string
+	s    *msg.Service // nil for a delete
+	add  bool
+}
+
+// Reconcile makes the registered services match desired, keyed by UUID. It
+// fetches all services and compares them with desired like DiffServices,
+// except for the TTL, which the server reports as the time remaining. It
+// then adds the missing services, replaces the changed ones, which the
+// server can only do by deleting and adding them again, and, with Prune,
+// deletes those not desired. A desired service that fails ValidateService is
+// not applied and reported in the result's Errors, as are failed changes;
+// a service that is already gone when it is deleted is no error.
+//
+// The error is set when the services cannot be fetched, or when ctx is done
+// before all changes were made; the changes not attempted are then reported
+// with the error of ctx.
+func (c *Client) Reconcile(ctx context.Context, desired map[string]*msg.Service, opts ReconcileOptions) (ReconcileResult, error) {
+	res := ReconcileResult{Errors: make(map[string]error)}
+	services, err := c.GetAllServicesContext(ctx)
+	if err != nil {
+		return res, err
+	}
+	current := make(map[string]*msg.Service, len(services))
+	for _, s := range services {
+		if s == nil {
+			continue
+		}
+		if uuid := c.key(s); uuid != "" {
+			current[uuid] = s
+		}
+	}
+
+	// Compare with the current TTL, it counts down on the server.
+	want := make(map[string]*msg.Service, len(desired))
+	for uuid, d := range desired {
+		if err := ValidateService(d); err != nil {
+			res.Errors[uuid] = err
+			continue
+		}
+		if cur, ok := current[uuid]; ok && cur.TTL != d.TTL {
+			n := *d
+			n.TTL = cur.TTL
+			d = &n
+		}
+		want[uuid] = d
+	}
+	toAdd, toUpdate, toDelete := DiffServices(current, want)
+
+	var ops []reconcileOp
+	for uuid := range toAdd {
+		ops = append(ops, reconcileOp{uuid: uuid, s: desired[uuid], add: true})
+	}
+	for uuid := range toUpdate {
+		ops = append(ops, reconcileOp{uuid: uuid, s: desired[uuid]})
+	}
+	if opts.Prune {
+		for _, uuid := range toDelete {
+			if _, ok := res.Errors[uuid]; !ok {
+				ops = append(ops, reconcileOp{uuid: uuid})
+			}
+		}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		work = make(chan reconcileOp)
+	)
+	finish := func(op reconcileOp, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err != nil:
+			res.Errors[op.uuid] = err
+		case op.add:
+			res.Added++
+		case op.s != nil:
+			res.Updated++
+		default:
+			res.Deleted++
+		}
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for op := range work {
+				var err error
+				switch {
+				case op.add:
+					_, err = c.add(ctx, op.uuid, op.s, true)
+				case op.s != nil:
+					// Known to differ, so replace it without comparing again.
+					_, err = c.del(ctx, op.uuid)
+					if err == nil || errors.Is(err, ErrServiceNotFound) {
+						_, err = c.add(ctx, op.uuid, op.s, false)
+					}
+				default:
+					_, err = c.del(ctx, op.uuid)
+					if errors.Is(err, ErrServiceNotFound) {
+						err = nil
+					}
+				}
+				finish(op, err)
+			}
+		}()
+	}
+	for _, op := range ops {
+		if ctx.Err() != nil {
+			finish(op, ctx.Err())
+			continue
+		}
+		select {
+		case work <- op:
+		case <-ctx.Done():
+			finish(op, ctx.Err())
+		}
+	}
+	close(work)
+	wg.Wait()
+	return res, ctx.Err()
+}
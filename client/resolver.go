@@ -0,0 +1,121 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"github.com/skynetservices/skydns1/msg"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolverInterval is how often a Resolver polls for changes.
+const resolverInterval = 10 * time.Second
+
+// A Resolver answers lookups from an in-memory copy of all services, kept
+// current with Watch. Its methods are safe for concurrent use.
+type Resolver struct {
+	mu       sync.RWMutex
+	services map[string]*msg.Service // keyed by key
+	key      func(*msg.Service) string
+	err      error
+	done     chan struct{}
+}
+
+// NewCachedResolver fetches all services and returns a Resolver serving
+// lookups from them without network round trips. The Resolver polls for
+// changes every 10 seconds until ctx is done. An error of the initial fetch
+// is returned, later failed polls keep the last known services, see Err.
+func (c *Client) NewCachedResolver(ctx context.Context) (*Resolver, error) {
+	services, err := c.GetAllServicesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := &Resolver{services: c.ServiceMap(services), key: c.key, done: make(chan struct{})}
+	events := c.Watch(ctx, resolverInterval, 0)
+	go func() {
+		defer close(r.done)
+		first := true
+		for ev := range events {
+			r.apply(ev, first)
+			if ev.Err == nil {
+				first = false
+			}
+		}
+	}()
+	return r, nil
+}
+
+// apply updates the services with ev. The first event of Watch holds all
+// services, so it replaces them.
+func (r *Resolver) apply(ev WatchEvent, replace bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = ev.Err
+	if ev.Err != nil {
+		return
+	}
+	if replace {
+		r.services = make(map[string]*msg.Service, len(ev.Added))
+	}
+	for _, s := range ev.Added {
+		r.services[r.key(s)] = s
+	}
+	for _, s := range ev.Changed {
+		r.services[r.key(s)] = s
+	}
+	for _, s := range ev.Removed {
+		delete(r.services, r.key(s))
+	}
+}
+
+// Lookup returns copies of the services matching name, relative to the
+// domain as in a DNS query, sorted by UUID. Like SkyDNS, name holds the
+// rightmost labels of the full service name
+// <uuid>.<host>.<region>.<version>.<service>.<environment>, where * matches
+// any label, so web.production matches the service web in every version and
+// region of production.
+func (r *Resolver) Lookup(name string) []*msg.Service {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*msg.Service, 0)
+	for _, s := range r.services {
+		if matchLabels(strings.Split(serviceName(s), "."), labels) {
+			out = append(out, copyService(s))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UUID < out[j].UUID })
+	return out
+}
+
+// matchLabels reports whether labels match the rightmost labels of full.
+func matchLabels(full, labels []string) bool {
+	if len(labels) > len(full) {
+		return false
+	}
+	full = full[len(full)-len(labels):]
+	for i, l := range labels {
+		if l != "*" && l != full[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns the error of the last poll for changes, nil if it succeeded.
+func (r *Resolver) Err() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.err
+}
+
+// Done returns a channel that is closed when the Resolver stopped polling,
+// after its context is done.
+func (r *Resolver) Done() <-chan struct{} {
+	return r.done
+}
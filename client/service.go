@@ -0,0 +1,164 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ServiceAddr returns the host:port address to dial service s. Hosts that
+// are IPv6 literals are bracketed, a trailing dot on a host name is removed.
+func ServiceAddr(s *msg.Service) (string, error) {
+	if s == nil || s.Host == "" {
+		return "", ErrNoHost
+	}
+	if s.Port == 0 {
+		return "", ErrNoPort
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(s.Host, "["), "]")
+	if net.ParseIP(host) == nil {
+		host = strings.TrimSuffix(host, ".")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(s.Port))), nil
+}
+
+// ServiceToSRV returns the SRV record with owner name that SkyDNS serves for
+// s in domain when s is the only service answering: priority 10, weight 100,
+// the port and TTL of s, and as target the host of s or, if that is an IP
+// address, <uuid>.<domain>, which SkyDNS resolves to the address.
+func ServiceToSRV(name, domain string, s *msg.Service) *dns.SRV {
+	target := dns.Fqdn(s.Host)
+	if net.ParseIP(s.Host) != nil {
+		target = s.UUID + "." + dns.Fqdn(domain)
+	}
+	return &dns.SRV{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: s.TTL},
+		Priority: 10, Weight: 100, Port: s.Port, Target: target}
+}
+
+// SRVToService returns a service with the Host, from the target, Port and TTL
+// of srv. A target of the form <uuid>.<domain> stands for an IP address that
+// is only found in the A or AAAA record for it.
+func SRVToService(srv *dns.SRV) *msg.Service {
+	return &msg.Service{Host: strings.TrimSuffix(srv.Target, "."), Port: srv.Port, TTL: srv.Hdr.Ttl}
+}
+
+// ValidateService checks s the way the server does when it is added: it must
+// have a Host and a Port. It returns ErrNoHost or ErrNoPort otherwise.
+func ValidateService(s *msg.Service) error {
+	if s == nil || s.Host == "" {
+		return ErrNoHost
+	}
+	if s.Port == 0 {
+		return ErrNoPort
+	}
+	return nil
+}
+
+// ValidateCallback checks that the server can use cb: it must name the
+// service it is for and the server must be able to reach it. SkyDNS has a
+// single kind of callback, fired when a matching service is removed or
+// expires, by a DELETE to http://<Reply>:<Port>/skydns/callbacks/<uuid>, so
+// Reply must be a host name or IP address, with IPv6 addresses in brackets,
+// and Port must be set. The error wraps ErrInvalidCallback.
+func ValidateCallback(cb *msg.Callback) error {
+	switch {
+	case cb == nil:
+		return ErrInvalidCallback
+	case cb.Name == "":
+		return fmt.Errorf("%w: no service name", ErrInvalidCallback)
+	case cb.Port == 0:
+		return fmt.Errorf("%w: no port", ErrInvalidCallback)
+	}
+	host := net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(cb.Reply, "["), "]"), strconv.Itoa(int(cb.Port)))
+	u, err := url.Parse("http://" + cb.Reply + ":" + strconv.Itoa(int(cb.Port)) + "/")
+	if cb.Reply == "" || err != nil || u.Host != host || u.User != nil {
+		return fmt.Errorf("%w: reply host %q", ErrInvalidCallback, cb.Reply)
+	}
+	return nil
+}
+
+// ValidateServices runs ValidateService on each of services, keyed by UUID,
+// without contacting the server, and returns the errors of the invalid ones
+// by UUID. An empty UUID is reported as ErrNoUUID. The map is empty if all
+// services are valid.
+func ValidateServices(services map[string]*msg.Service) map[string]error {
+	errs := make(map[string]error)
+	for uuid, s := range services {
+		if uuid == "" {
+			errs[uuid] = ErrNoUUID
+			continue
+		}
+		if err := ValidateService(s); err != nil {
+			errs[uuid] = err
+		}
+	}
+	return errs
+}
+
+// ServiceEqual reports whether a and b describe the same registration: their
+// Name, Version, Environment, Region, Host, Port, TTL, NoExpire and Metadata
+// are equal. The UUID, the expiry and the callbacks are ignored, the server
+// sets those. A nil and an empty Metadata are equal.
+func ServiceEqual(a, b *msg.Service) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Name != b.Name || a.Version != b.Version || a.Environment != b.Environment ||
+		a.Region != b.Region || a.Host != b.Host || a.Port != b.Port ||
+		a.TTL != b.TTL || a.NoExpire != b.NoExpire || len(a.Metadata) != len(b.Metadata) {
+		return false
+	}
+	for k, v := range a.Metadata {
+		if w, ok := b.Metadata[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ServiceHash returns a hex encoded SHA-256 hash of the fields compared by
+// ServiceEqual, so equal services hash the same. It is stable across
+// processes and can be stored for change detection.
+func ServiceHash(s *msg.Service) string {
+	if s == nil {
+		s = &msg.Service{}
+	}
+	metadata := s.Metadata
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	// Marshal sorts map keys, which makes the encoding canonical.
+	b, _ := json.Marshal([]interface{}{s.Name, s.Version, s.Environment, s.Region,
+		s.Host, s.Port, s.TTL, s.NoExpire, metadata})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// SetMetadata sets the metadata key of s to value, creating the map if
+// needed.
+func SetMetadata(s *msg.Service, key, value string) {
+	if s.Metadata == nil {
+		s.Metadata = make(map[string]string)
+	}
+	s.Metadata[key] = value
+}
+
+// GetMetadata returns the metadata key of s and whether it is set.
+func GetMetadata(s *msg.Service, key string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	v, ok := s.Metadata[key]
+	return v, ok
+}
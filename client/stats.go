@@ -0,0 +1,43 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"sync/atomic"
+)
+
+// ClientStats is a snapshot of the client's request counters.
+type ClientStats struct {
+	Requests   int64 // HTTP requests sent
+	InFlight   int64 // HTTP requests currently awaiting a response
+	Errors     int64 // HTTP requests that failed without a response
+	DNSQueries int64 // DNS exchanges performed
+	DNSErrors  int64 // DNS exchanges that failed
+	Retries    int64 // requests and exchanges that were retried
+}
+
+// clientStats holds the live counters, it is shared between copies of a
+// Client and only accessed atomically.
+type clientStats struct {
+	requests   int64
+	inFlight   int64
+	errors     int64
+	dnsQueries int64
+	dnsErrors  int64
+	retries    int64
+}
+
+// Stats returns a snapshot of the client's counters. It is safe to call
+// concurrently with requests.
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		Requests:   atomic.LoadInt64(&c.stats.requests),
+		InFlight:   atomic.LoadInt64(&c.stats.inFlight),
+		Errors:     atomic.LoadInt64(&c.stats.errors),
+		DNSQueries: atomic.LoadInt64(&c.stats.dnsQueries),
+		DNSErrors:  atomic.LoadInt64(&c.stats.dnsErrors),
+		Retries:    atomic.LoadInt64(&c.stats.retries),
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WithHTTPClient makes the client send its requests with h. If h has no
+// CheckRedirect, the client's redirect handling is used. The transport of h
+// is not copied, options given after this one that tune the transport change
+// it for every user of h.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) error {
+		if h == nil {
+			return ErrInvalidHTTPClient
+		}
+		n := *h
+		if n.CheckRedirect == nil {
+			n.CheckRedirect = c.checkRedirect
+		}
+		c.h = &n
+		return nil
+	}
+}
+
+// WithTransport makes the client send its requests through rt, keeping the
+// client's redirect handling. Give several clients, and other HTTP clients,
+// the same rt to have them share its connection pool; rt must then be safe
+// for concurrent use, as an *http.Transport is. Options given after this one
+// that tune the transport change it for every user of rt.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) error {
+		if rt == nil {
+			return ErrInvalidTransport
+		}
+		c.h.Transport = rt
+		return nil
+	}
+}
+
+// Transport returns the transport the client sends its requests through,
+// http.DefaultTransport if its HTTP client has none, for sharing with other
+// clients by WithTransport. Clients derived with ForDomain or ForDNSServer
+// share the transport of their parent. Changing the transport's settings
+// after requests were sent is not safe.
+func (c *Client) Transport() http.RoundTripper {
+	if c.h.Transport == nil {
+		return http.DefaultTransport
+	}
+	return c.h.Transport
+}
+
+// WithHTTP2 enables or disables HTTP/2 on the client's transport. HTTP/2 is
+// only negotiated over TLS; note that the SkyDNS server announces only
+// HTTP/1.1 on its TLS listener, so this is of use with fronting proxies or
+// servers that do speak HTTP/2. The client's transport must be an
+// *http.Transport.
+func WithHTTP2(enable bool) Option {
+	return func(c *Client) error {
+		t, err := c.transport()
+		if err != nil {
+			return err
+		}
+		t.ForceAttemptHTTP2 = enable
+		if !enable {
+			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+		return nil
+	}
+}
+
+// WithProxy makes the client send its requests through the proxy returned by
+// proxy, see http.Transport.Proxy. A nil proxy disables proxying. Without
+// this option the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables. The client's transport must be an
+// *http.Transport.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) Option {
+	return func(c *Client) error {
+		t, err := c.transport()
+		if err != nil {
+			return err
+		}
+		t.Proxy = proxy
+		return nil
+	}
+}
+
+// transport returns the *http.Transport of the client's http.Client, a copy
+// of http.DefaultTransport is installed if it has none. The copy keeps
+// reading the proxy settings from the environment.
+func (c *Client) transport() (*http.Transport, error) {
+	if c.h.Transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = http.ProxyFromEnvironment
+		c.h.Transport = t
+		return t, nil
+	}
+	t, ok := c.h.Transport.(*http.Transport)
+	if !ok {
+		return nil, ErrNotTransport
+	}
+	return t, nil
+}
+
+// WithDialTimeout bounds the time to set up a TCP connection to the HTTP
+// server. The client's transport must be an *http.Transport.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) error {
+		t, err := c.transport()
+		if err != nil {
+			return err
+		}
+		t.DialContext = (&net.Dialer{Timeout: d, KeepAlive: 30 * time.Second}).DialContext
+		return nil
+	}
+}
+
+// WithTLSHandshakeTimeout bounds the time of the TLS handshake with the HTTP
+// server. The client's transport must be an *http.Transport.
+func WithTLSHandshakeTimeout(d time.Duration) Option {
+	return func(c *Client) error {
+		t, err := c.transport()
+		if err != nil {
+			return err
+		}
+		t.TLSHandshakeTimeout = d
+		return nil
+	}
+}
+
+// WithResponseHeaderTimeout bounds the time between sending a request and
+// receiving the response headers. Reading the body is not bounded, so large
+// service lists can still be streamed. The client's transport must be an
+// *http.Transport.
+func WithResponseHeaderTimeout(d time.Duration) Option {
+	return func(c *Client) error {
+		t, err := c.transport()
+		if err != nil {
+			return err
+		}
+		t.ResponseHeaderTimeout = d
+		return nil
+	}
+}
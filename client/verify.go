@@ -0,0 +1,73 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// A VerifyError is returned by Verify. Its Reason is ErrUnreachable,
+// ErrUnauthorized or ErrServerError, both it and the underlying error can be
+// tested with errors.Is.
+type VerifyError struct {
+	Reason error
+	Status int   // HTTP status code, zero if the server was not reached
+	Err    error // underlying error, if any
+}
+
+func (e *VerifyError) Error() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+	case e.Status != 0:
+		return fmt.Sprintf("%s: %d %s", e.Reason, e.Status, http.StatusText(e.Status))
+	}
+	return e.Reason.Error()
+}
+
+func (e *VerifyError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Reason}
+	}
+	return []error{e.Reason, e.Err}
+}
+
+// Warmup sets up a connection to the server, so the first real request does
+// not pay for the TCP and TLS handshakes, and checks it like Verify.
+func (c *Client) Warmup(ctx context.Context) error {
+	return c.Verify(ctx)
+}
+
+// Verify checks that the server can be reached and accepts the client's
+// secret by sending it a small authenticated request. Call it at startup to
+// tell a wrong address from a wrong secret or a failing server before the
+// first registration; the returned error is a *VerifyError.
+func (c *Client) Verify(ctx context.Context) error {
+	req, err := c.newRequestContext(ctx, "GET", fmt.Sprintf("%s/skydns/regions/", c.base), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return &VerifyError{Reason: ErrUnreachable, Err: err}
+	}
+	resp.Body.Close()
+	return verifyStatus(resp.StatusCode)
+}
+
+// verifyStatus returns the *VerifyError for the status of a verify request,
+// nil if it succeeded.
+func verifyStatus(status int) error {
+	switch {
+	case status >= 200 && status < 300:
+		return nil
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return &VerifyError{Reason: ErrUnauthorized, Status: status}
+	default:
+		return &VerifyError{Reason: ErrServerError, Status: status}
+	}
+}
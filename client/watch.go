@@ -0,0 +1,100 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"github.com/skynetservices/skydns1/msg"
+	"time"
+)
+
+// A WatchEvent describes how the services changed between two polls of
+// Watch. If the poll failed, only Err is set.
+type WatchEvent struct {
+	Added   []*msg.Service
+	Changed []*msg.Service
+	Removed []*msg.Service
+	Err     error
+}
+
+// Watch polls the list of services every interval and sends an event on the
+// returned channel each time it changed, the first event holds all services
+// as added. Every poll must finish within timeout, a poll that takes longer
+// is abandoned and reported as an event with Err set; a timeout of zero or
+// less uses interval. The channel is closed when ctx is done. An interval of
+// zero or less sends a single event with Err set to ErrInvalidInterval and
+// closes the channel.
+func (c *Client) Watch(ctx context.Context, interval, timeout time.Duration) <-chan WatchEvent {
+	if interval <= 0 {
+		events := make(chan WatchEvent, 1)
+		events <- WatchEvent{Err: ErrInvalidInterval}
+		close(events)
+		return events
+	}
+	if timeout <= 0 {
+		timeout = interval
+	}
+	events := make(chan WatchEvent)
+	go func() {
+		defer close(events)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		var last map[string]*msg.Service
+		for {
+			pctx, cancel := context.WithTimeout(ctx, timeout)
+			services, err := c.GetAllServicesContext(pctx)
+			cancel()
+
+			var ev WatchEvent
+			send := true
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				ev.Err = err
+			default:
+				cur := c.ServiceMap(services)
+				ev = diffWatch(last, cur)
+				send = last == nil || len(ev.Added)+len(ev.Changed)+len(ev.Removed) > 0
+				last = cur
+			}
+			if send {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// diffWatch returns the changes going from old to cur.
+func diffWatch(old, cur map[string]*msg.Service) WatchEvent {
+	var ev WatchEvent
+	for uuid, s := range cur {
+		o, ok := old[uuid]
+		switch {
+		case !ok:
+			ev.Added = append(ev.Added, s)
+		case !sameService(o, s):
+			ev.Changed = append(ev.Changed, s)
+		}
+	}
+	for uuid, s := range old {
+		if _, ok := cur[uuid]; !ok {
+			ev.Removed = append(ev.Removed, s)
+		}
+	}
+	return ev
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// dnsTimeout is the timeout of a tapped exchange when neither its context
+// nor the DNS client set one, the default of the dns package.
+const dnsTimeout = 2 * time.Second
+
+// WithDNSWireTap calls tap with the wire format of every DNS query the
+// client sends and of the reply it receives, for capturing the exchanges
+// where a packet capture is not possible. A truncated UDP reply retried over
+// TCP makes two calls. received is nil if no reply was read. tap is called
+// from the goroutine doing the query, it must be safe for concurrent use and
+// must not keep or modify the slices. Without a tap, queries are exchanged
+// by the dns package as usual.
+func WithDNSWireTap(tap func(sent, received []byte)) Option {
+	return func(c *Client) error {
+		c.wireTap = tap
+		return nil
+	}
+}
+
+// exchangeWith exchanges m with the DNS server using d, passing the packets
+// to the wire tap if there is one.
+func (c *Client) exchangeWith(ctx context.Context, d *dns.Client, m *dns.Msg) (*dns.Msg, error) {
+	if c.wireTap == nil {
+		r, _, err := d.ExchangeContext(ctx, m, c.basedns)
+		return r, err
+	}
+
+	conn, err := d.DialContext(ctx, c.basedns)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+	return c.exchangeOn(ctx, conn, make([]byte, dns.MaxMsgSize), m)
+}
@@ -25,6 +25,7 @@ type Service struct {
 	Expires     time.Time
 	Callback    map[string]Callback `json:"-"` // Callbacks are found by UUID
 	NoExpire    bool                // don't expire the service based on the ttl
+	Metadata    map[string]string   `json:",omitempty"` // free form tags, e.g. team or tier
 }
 
 // RemainingTTL returns the amount of time remaining before expiration.